@@ -0,0 +1,163 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	c "local-pass-sync/config"
+	s "local-pass-sync/server"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the client copies the local file into the backup directory before it replaces the file with a file of the server
+// the backups are named <name of the local file>-<time>.kdbx, so they are sorted by their time
+
+// the layout of the time in the backup names
+const backupTimeLayout = "20060102T150405.000000000Z"
+
+// returns the directory of the backups, without a configured directory the backups are next to the local file
+func backupDirectory(cfg c.Config) string{
+	if cfg.Keepass.BackupPath != "" {
+		return cfg.Keepass.BackupPath
+	}
+	return filepath.Join(filepath.Dir(cfg.Keepass.ClientPath), "backups")
+}
+
+// returns the prefix of the backup names for the local file
+func backupPrefix(cfg c.Config) string{
+	name := filepath.Base(cfg.Keepass.ClientPath)
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "-"
+}
+
+// saves a backup of the local file and removes the oldest backups which exceed the configured count
+// nothing is saved if the backups are disabled or the local file doesn't exist yet
+func backupLocalFile(cfg c.Config) error{
+	if cfg.Keepass.BackupCount <= 0 {
+		return nil
+	}
+
+	file, err := ioutil.ReadFile(cfg.Keepass.ClientPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+
+	if err := os.MkdirAll(backupDirectory(cfg), 0700); err != nil{
+		return err
+	}
+	name := backupPrefix(cfg) + time.Now().UTC().Format(backupTimeLayout) + ".kdbx"
+	if err := ioutil.WriteFile(filepath.Join(backupDirectory(cfg), name), file, 0600); err != nil{
+		return err
+	}
+
+	backups, err := listBackups(cfg)
+	if err != nil{
+		return err
+	}
+	for i := cfg.Keepass.BackupCount; i < len(backups); i++{
+		if err := os.Remove(filepath.Join(backupDirectory(cfg), backups[i])); err != nil{
+			log.Println("An old backup could not be removed: ", err)
+		}
+	}
+	return nil
+}
+
+// returns the names of the backups of the local file, the newest backup is the first
+func listBackups(cfg c.Config) ([]string, error){
+	files, err := ioutil.ReadDir(backupDirectory(cfg))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil{
+		return nil, err
+	}
+
+	var backups []string
+	times := make(map[string]time.Time)
+	for _, file := range files{
+		if backupTime, ok := parseBackupName(cfg, file.Name()); ok && !file.IsDir() {
+			backups = append(backups, file.Name())
+			times[file.Name()] = backupTime
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool{
+		return times[backups[i]].After(times[backups[j]])
+	})
+	return backups, nil
+}
+
+// returns the time of a backup name, the name has to be <name of the local file>-<time>.kdbx
+// the backups of other files in the same directory (e.g. of local-old.kdbx for local.kdbx) are rejected, because their time can't be parsed
+func parseBackupName(cfg c.Config, name string) (time.Time, bool){
+	prefix := backupPrefix(cfg)
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".kdbx") {
+		return time.Time{}, false
+	}
+	backupTime, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".kdbx"))
+	if err != nil{
+		return time.Time{}, false
+	}
+	return backupTime, true
+}
+
+// HandlingListBackups prints the backups of the local file, the newest backup is the first
+func HandlingListBackups(cfg c.Config){
+	backups, err := listBackups(cfg)
+	if err != nil{
+		log.Fatal("While reading the backups, the following error occurred: ", err)
+	}
+	if len(backups) == 0 {
+		fmt.Println("There are no backups of the local file.")
+		return
+	}
+	for _, backup := range backups{
+		fmt.Println(backup)
+	}
+}
+
+// HandlingRestoreLocal replaces the local file with a backup, without a name the newest backup is restored
+// the current local file is saved as a backup first, so the restore can be undone
+func HandlingRestoreLocal(cfg c.Config, name string){
+	file, err := readBackup(cfg, name)
+	if err != nil{
+		log.Fatal("While reading the backup, the following error occurred: ", err)
+	}
+
+	if err := backupLocalFile(cfg); err != nil{
+		log.Fatal("While saving a backup of the local file, the following error occurred: ", err)
+	}
+	err = s.WriteFileAtomically(cfg.Keepass.ClientPath, file, verifyLocalFile(cfg))
+	if err != nil{
+		log.Fatal("While restoring the backup, the following error occurred: ", err)
+	}
+	log.Println("The backup was restored, use replaceFile to replace the server file with it.")
+}
+
+// returns the content of the backup with the given name or of the newest backup if the name is empty
+// only the names of the backups are accepted, so the name can't point to a file outside of the backup directory
+func readBackup(cfg c.Config, name string) ([]byte, error){
+	backups, err := listBackups(cfg)
+	if err != nil{
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, errors.New("there are no backups of the local file")
+	}
+	if name == "" {
+		name = backups[0]
+	}
+
+	for _, backup := range backups{
+		if backup == name {
+			return ioutil.ReadFile(filepath.Join(backupDirectory(cfg), backup))
+		}
+	}
+	return nil, fmt.Errorf("there is no backup %s", name)
+}
@@ -3,10 +3,12 @@ package client
 import (
 	"bytes"
 	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"github.com/tobischo/gokeepasslib/v3"
 	"io/ioutil"
 	c "local-pass-sync/config"
 	k "local-pass-sync/key"
@@ -14,14 +16,44 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// creates a request with the given config, method, path and the body payload
-func createRequest(cfg c.Config, body *bytes.Reader, method string, apiPath string) (*http.Request, error){
-	req, err := http.NewRequest(method, "https://" + cfg.Server.Domain + ":" + cfg.Server.Port + apiPath, body)
+// creates a request with the given config, method, path and the body payload, the request is signed by signRequest
+func createRequest(cfg c.Config, payload s.Payload, method string, apiPath string) (*http.Request, error){
+	privateKey, pubKey := k.GetPublicAndPrivateKey(cfg.Ed25519private.Path, cfg.Ed25519private.Password)
+	payload.Key = k.PublicKeyToString(pubKey)
+	body, err := json.Marshal(payload)
+	if err != nil{
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, "https://" + cfg.Server.Domain + ":" + cfg.Server.Port + apiPath, bytes.NewReader(body))
+	if err != nil{
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
-	return req, err
+	return req, signRequest(req, privateKey, body)
+}
+
+// signs the request envelope with the method, the path, the current time, a random nonce and the hash of the body
+// the signature, the time and the nonce are sent as headers, the server rejects the request if it is changed,
+// sent again or sent to another endpoint
+func signRequest(req *http.Request, privateKey ed25519.PrivateKey, body []byte) error{
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil{
+		return err
+	}
+	timestamp := time.Now().Unix()
+	nonce := base64.StdEncoding.EncodeToString(nonceBytes)
+
+	envelope := s.RequestEnvelope(req.Method, req.URL.Path, timestamp, nonce, body)
+	req.Header.Set(s.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(s.NonceHeader, nonce)
+	req.Header.Set(s.SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, envelope)))
+	return nil
 }
 
 // creates a client for a https request
@@ -45,9 +77,38 @@ func createTlsClient(cfg c.Config) *http.Client{
 	return client
 }
 
+// Options contains the command line options of the client
+type Options struct {
+	// JSON prints the change report as JSON instead of text
+	JSON bool
+	// DryRun only prints the changes of compareFiles and replaceFile, the local and the server file stay untouched
+	DryRun bool
+	// Force replaces the server file with replaceFile even if it was changed since the last sync of the client
+	Force bool
+	// KeyFile opens the first file of diff together with the password, which is never passed as an option
+	KeyFile string
+	// SecondKeyFile opens the second file of diff, without it and a second password the second file uses the first credentials
+	SecondKeyFile string
+	// PasswordStdin reads the passwords of diff from stdin, one per line, instead of a prompt
+	PasswordStdin bool
+}
+
 // Writes the response data to disk if a file was send
 // The Boolean indicated if there is a new file
 func handleResponse(cfg c.Config, resp *http.Response) (error, bool){
+	returnPayload, err := readResponse(resp)
+	if err != nil{
+		return err, false
+	}
+	err, changed := writeResponseFile(cfg, returnPayload)
+	if err == nil{
+		saveVersion(cfg, returnPayload.Version)
+	}
+	return err, changed
+}
+
+// decodes the response of the server and stops the client if the server didn't accept the request
+func readResponse(resp *http.Response) (s.Payload, error){
 	var returnPayload s.Payload
 
 	if strings.Contains(resp.Status, "404") || strings.Contains(resp.Status, "500"){
@@ -55,7 +116,7 @@ func handleResponse(cfg c.Config, resp *http.Response) (error, bool){
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&returnPayload); err != nil {
-		return err, false
+		return returnPayload, err
 	}
 
 	if !strings.Contains(resp.Status, "200"){
@@ -63,7 +124,12 @@ func handleResponse(cfg c.Config, resp *http.Response) (error, bool){
 	}
 
 	log.Printf(returnPayload.Message)
+	return returnPayload, nil
+}
 
+// writes the file of the response to disk
+// The Boolean indicated if there is a new file
+func writeResponseFile(cfg c.Config, returnPayload s.Payload) (error, bool){
 	// Checks if there is a new file to write to disk
 	if len(returnPayload.File) == 0{
 		return nil, false
@@ -74,35 +140,95 @@ func handleResponse(cfg c.Config, resp *http.Response) (error, bool){
 		return err, false
 	}
 
-	outFile, err := os.Create(cfg.Keepass.ClientPath)
-	if err != nil{
+	if err := backupLocalFile(cfg); err != nil{
 		return err, false
 	}
+	err = s.WriteFileAtomically(cfg.Keepass.ClientPath, decodedFile, verifyLocalFile(cfg))
+	return err, err == nil
+}
 
-	_, err = outFile.Write(decodedFile)
-	if err != nil {
-		return err, false
+// returns the check for a written local file, the client opens the file with the credentials of its config
+func verifyLocalFile(cfg c.Config) func(written []byte) error{
+	return func(written []byte) error {
+		credentials, err := localCredentials(cfg)
+		if err != nil{
+			return err
+		}
+		return s.VerifyClientFile(written, credentials)
+	}
+}
+
+// returns the credentials of the local file from the config
+// without its own client credentials the local file uses the same credentials as the server file,
+// nil is returned if the config has no credentials at all, so the client can't open its file
+func localCredentials(cfg c.Config) (*gokeepasslib.DBCredentials, error){
+	if cfg.Keepass.ClientPassword != "" || cfg.Keepass.ClientKeyFile != "" {
+		return s.CreateCredentials(cfg.Keepass.ClientPassword, cfg.Keepass.ClientKeyFile)
+	}
+	if cfg.Keepass.Password != "" || cfg.Keepass.KeyFile != "" {
+		return s.CreateCredentials(cfg.Keepass.Password, cfg.Keepass.KeyFile)
 	}
-	return outFile.Close(), true
+	return nil, nil
 }
 
-// creates a byte reader from the kdbx file and the ed25519 keys
-// the returned reader can be used as the body parameter for a http request
-func createFileRequestBody(cfg c.Config) (*bytes.Reader, error) {
+// creates the payload with the local kdbx file, it is signed by createRequest
+// with a dry run the server only returns the changes
+func createFileRequestBody(cfg c.Config, version string, opts Options) (s.Payload, error) {
 	f, err := ioutil.ReadFile(cfg.Keepass.ClientPath)
 	if err != nil {
-		return nil, err
+		return s.Payload{}, err
+	}
+	return createUploadRequestBody(cfg, f, version, opts)
+}
+
+// creates the payload with the given kdbx file, it is signed by createRequest
+// the server only replaces its file if it still has the given version, unless the replacement is forced
+func createUploadRequestBody(cfg c.Config, f []byte, version string, opts Options) (s.Payload, error) {
+	credentials, err := createCredentials(cfg)
+	if err != nil {
+		return s.Payload{}, err
+	}
+
+	return s.Payload{
+		File:        base64.StdEncoding.EncodeToString(f),
+		Credentials: credentials,
+		Version:     version,
+		DryRun:      opts.DryRun,
+		Force:       opts.Force,
+	}, nil
+}
+
+// creates the credentials of the client file from the config
+// nil is returned if the client file uses the same credentials as the server file
+// or the server runs in the end-to-end mode, where it never gets the credentials
+func createCredentials(cfg c.Config) (*s.Credentials, error){
+	if cfg.Keepass.EndToEnd || (cfg.Keepass.ClientPassword == "" && cfg.Keepass.ClientKeyFile == "") {
+		return nil, nil
 	}
-	privateKey, pubKey := k.GetPublicAndPrivateKey(cfg.Ed25519private.Path, cfg.Ed25519private.Password)
 
-	payload := s.Payload{
-		Key:       k.PublicKeyToString(pubKey),
-		File:      base64.StdEncoding.EncodeToString(f),
-		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, f)),
+	// only the hash of the password and the key of the key file are sent to the server
+	credentials, err := s.CreateCredentials(cfg.Keepass.ClientPassword, cfg.Keepass.ClientKeyFile)
+	if err != nil {
+		return nil, err
 	}
+	return &s.Credentials{Passphrase: credentials.Passphrase, Key: credentials.Key}, nil
+}
 
-	payloadBytes, err := json.Marshal(payload)
+// sends a request to the api path and returns the decoded response and its status code
+func sendRequest(cfg c.Config, body s.Payload, method string, apiPath string) (s.Payload, int, error){
+	var payload s.Payload
 
-	return bytes.NewReader(payloadBytes), err
+	req, err := createRequest(cfg, body, method, apiPath)
+	if err != nil{
+		return payload, 0, err
+	}
+
+	resp, err := createTlsClient(cfg).Do(req)
+	if err != nil{
+		return payload, 0, err
+	}
+	defer resp.Body.Close()
 
-}
\ No newline at end of file
+	err = json.NewDecoder(resp.Body).Decode(&payload)
+	return payload, resp.StatusCode, err
+}
@@ -1,14 +1,188 @@
 package client
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	c "local-pass-sync/config"
+	m "local-pass-sync/merge"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writes a self-signed certificate into a temporary directory and returns a config which uses it
+func createTestConfig(t testing.TB) c.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg c.Config
+	cfg.SslCertificate.SelfSignedCertificate = filepath.Join(t.TempDir(), "cert.pem")
+	certFile := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	if err := os.WriteFile(cfg.SslCertificate.SelfSignedCertificate, certFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
 
 func TestCreateClient(t *testing.T) {
-	client := createClient()
+	client := createTlsClient(createTestConfig(t))
 	if client == nil{
 		t.Errorf("empty client")
 	}
 }
 
+func TestCreateCredentials(t *testing.T) {
+	var cfg c.Config
+	if credentials, err := createCredentials(cfg); err != nil || credentials != nil {
+		t.Errorf("expected no credentials without a client password, got %v %v", credentials, err)
+	}
+
+	cfg.Keepass.ClientPassword = "client password"
+	credentials, err := createCredentials(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials.Passphrase) != 32 || credentials.Key != nil {
+		t.Errorf("expected only the hashed password, got %v", credentials)
+	}
+}
+
+func TestLocalCredentials(t *testing.T) {
+	var cfg c.Config
+	if credentials, err := localCredentials(cfg); err != nil || credentials != nil {
+		t.Errorf("expected no credentials without a password, got %v %v", credentials, err)
+	}
+
+	// without its own client credentials the local file uses the credentials of the server file
+	cfg.Keepass.Password = "server password"
+	serverCredentials, err := localCredentials(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Keepass.ClientPassword = "client password"
+	clientCredentials, err := localCredentials(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(serverCredentials.Passphrase, clientCredentials.Passphrase) {
+		t.Error("expected the client password to be used for the local file")
+	}
+}
+
 func BenchmarkCreateClient(b *testing.B) {
-	createClient()
+	cfg := createTestConfig(b)
+	for i := 0; i < b.N; i++ {
+		createTlsClient(cfg)
+	}
+}
+
+func TestFormatChange(t *testing.T) {
+	change := m.Change{Type: m.Updated, Title: "mail", GroupPath: "Root/Mail", Winner: m.Local, Fields: []string{"UserName", "Password"}}
+	if line := formatChange(change); line != "updated   Root/Mail/mail (local wins): UserName, Password" {
+		t.Errorf("unexpected line %q", line)
+	}
+}
+
+func TestBackupLocalFileKeepsNewestBackups(t *testing.T) {
+	var cfg c.Config
+	cfg.Keepass.ClientPath = filepath.Join(t.TempDir(), "local.kdbx")
+	cfg.Keepass.BackupCount = 2
+
+	for _, content := range []string{"first", "second", "third"} {
+		if err := os.WriteFile(cfg.Keepass.ClientPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupLocalFile(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := listBackups(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %d", len(backups))
+	}
+
+	file, err := readBackup(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(file) != "third" {
+		t.Errorf("expected the newest backup, got %q", file)
+	}
+	if _, err := readBackup(cfg, "../local.kdbx"); err == nil {
+		t.Error("expected an error for a name which isn't a backup")
+	}
+}
+
+// only the backups of the local file are listed, the backups of local-old.kdbx and other files are ignored
+func TestListBackupsParsesBackupNames(t *testing.T) {
+	var cfg c.Config
+	cfg.Keepass.ClientPath = filepath.Join(t.TempDir(), "local.kdbx")
+
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(backupTimeLayout)
+	newer := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC).Format(backupTimeLayout)
+	names := []string{
+		"local-" + older + ".kdbx",
+		"local-" + newer + ".kdbx",
+		"local-old-" + newer + ".kdbx",
+		"local-notes.kdbx",
+		"local-" + newer + ".kdbx.tmp",
+	}
+	if err := os.MkdirAll(backupDirectory(cfg), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(backupDirectory(cfg), name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := listBackups(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"local-" + newer + ".kdbx", "local-" + older + ".kdbx"}
+	if strings.Join(backups, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the backups %v, got %v", expected, backups)
+	}
+}
+
+// the passwords of diff are read from the environment variable or line by line from stdin
+func TestReadPassword(t *testing.T) {
+	stdin := bufio.NewReader(strings.NewReader("first\r\nsecond"))
+
+	t.Setenv(PasswordEnv, "from env")
+	if password, err := readPassword(PasswordEnv, "", stdin, true); err != nil || password != "from env" {
+		t.Errorf("expected the password of the environment variable, got %q (%v)", password, err)
+	}
+
+	for _, expected := range []string{"first", "second", ""} {
+		if password, err := readPassword(SecondPasswordEnv, "", stdin, true); err != nil || password != expected {
+			t.Errorf("expected the password %q of stdin, got %q (%v)", expected, password, err)
+		}
+	}
 }
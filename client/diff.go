@@ -0,0 +1,86 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	s "local-pass-sync/server"
+	"log"
+	"os"
+	"strings"
+)
+
+// environment variables with the passwords of diff, they are used instead of stdin or the prompt (e.g. in scripts)
+const (
+	PasswordEnv       = "LOCAL_PASS_SYNC_PASSWORD"
+	SecondPasswordEnv = "LOCAL_PASS_SYNC_SECOND_PASSWORD"
+)
+
+// HandlingDiff prints the differences between two local keepass files without syncing them
+// the changes describe how the second file differs from the first file
+// the files are opened with the key files of the options and the passwords of readPassword, not with the credentials of the config
+func HandlingDiff(opts Options, firstPath string, secondPath string){
+	firstFile, err := ioutil.ReadFile(firstPath)
+	if err != nil{
+		log.Fatal(err)
+	}
+	secondFile, err := ioutil.ReadFile(secondPath)
+	if err != nil{
+		log.Fatal(err)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	firstPassword, err := readPassword(PasswordEnv, "Password of "+firstPath+": ", stdin, opts.PasswordStdin)
+	if err != nil{
+		log.Fatal("While reading the password, the following error occurred: ", err)
+	}
+	secondPassword, err := readPassword(SecondPasswordEnv, "Password of "+secondPath+" (empty for the first credentials): ", stdin, opts.PasswordStdin)
+	if err != nil{
+		log.Fatal("While reading the password, the following error occurred: ", err)
+	}
+
+	firstCredentials, err := s.CreateCredentials(firstPassword, opts.KeyFile)
+	if err != nil{
+		log.Fatal(err)
+	}
+	secondCredentials := firstCredentials
+	if secondPassword != "" || opts.SecondKeyFile != "" {
+		if secondCredentials, err = s.CreateCredentials(secondPassword, opts.SecondKeyFile); err != nil{
+			log.Fatal(err)
+		}
+	}
+
+	changes, err := s.DiffFiles(firstFile, firstCredentials, secondFile, secondCredentials)
+	if err != nil{
+		log.Fatal("While comparing the files, the following error occurred: ", err)
+	}
+	printChanges(changes, opts.JSON)
+}
+
+// reads a password of diff from the environment variable, the next line of stdin or a prompt without echo
+// the password is empty if stdin is no terminal and isn't selected with --password-stdin
+func readPassword(env string, prompt string, stdin *bufio.Reader, fromStdin bool) (string, error){
+	if password, ok := os.LookupEnv(env); ok {
+		return password, nil
+	}
+
+	if fromStdin {
+		line, err := stdin.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", nil
+	}
+	// the prompt is written to stderr, so the changes on stdout can be piped
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	c "local-pass-sync/config"
+	k "local-pass-sync/key"
+	s "local-pass-sync/server"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// how often the client merges and uploads the file again, if another client replaced the server file in the meantime
+const maxUploadAttempts = 3
+
+// compares the local file with the server file in the end-to-end mode
+// the client downloads the server file, merges it locally and uploads the result,
+// the upload only succeeds if the server file wasn't replaced since the download
+func handlingEndToEndCompare(cfg c.Config, opts Options){
+	_, pubKey := k.GetPublicAndPrivateKey(cfg.Ed25519private.Path, cfg.Ed25519private.Password)
+	credentials, err := s.CreateCredentials(cfg.Keepass.Password, cfg.Keepass.KeyFile)
+	if err != nil{
+		log.Fatal(err)
+	}
+	mergeOpts := s.MergeOptions(cfg, k.PublicKeyToString(pubKey))
+
+	for attempt := 0; attempt < maxUploadAttempts; attempt++ {
+		remoteFile, version, err := downloadServerFile(cfg)
+		if err != nil{
+			log.Fatal("While downloading the server file, the following error occurred: ", err)
+		}
+
+		localFile, err := ioutil.ReadFile(cfg.Keepass.ClientPath)
+		if err != nil{
+			log.Fatal(err)
+		}
+
+		merged, result, err := s.MergeFiles(localFile, remoteFile, loadSyncBase(cfg), credentials, mergeOpts)
+		if err != nil{
+			log.Fatal("While merging the local file with the server file, the following error occurred: ", err)
+		}
+		for _, mergeErr := range result.Errors{
+			log.Println("While merging the local file with the server file, the following error occurred: ", mergeErr)
+		}
+		if opts.DryRun{
+			log.Println("Dry run, nothing was saved.")
+			printChanges(result.Changes, opts.JSON)
+			return
+		}
+		if !result.Changed{
+			saveSyncBase(cfg, remoteFile)
+			saveVersion(cfg, version)
+			log.Println("Success, but no need to change files")
+			printChanges(result.Changes, opts.JSON)
+			return
+		}
+
+		newVersion, uploaded, err := uploadFile(cfg, merged, version)
+		if err != nil{
+			log.Fatal("While uploading the merged file, the following error occurred: ", err)
+		}
+		if !uploaded{
+			log.Println("The server file was changed in the meantime, the files are merged again.")
+			continue
+		}
+
+		if err := backupLocalFile(cfg); err != nil{
+			log.Fatal("While saving a backup of the local file, the following error occurred: ", err)
+		}
+		err = s.WriteFileAtomically(cfg.Keepass.ClientPath, merged, verifyLocalFile(cfg))
+		if err != nil{
+			log.Fatal(err)
+		}
+		saveSyncBase(cfg, merged)
+		saveVersion(cfg, newVersion)
+		log.Println("File was successfully changed on the client and the server")
+		printChanges(result.Changes, opts.JSON)
+		return
+	}
+	log.Fatal("The server file was changed by other clients during every attempt, please try again later.")
+}
+
+// prints the changes of the server file if the local file would replace it in the end-to-end mode
+func handlingEndToEndReplacementPreview(cfg c.Config, opts Options){
+	remoteFile, _, err := downloadServerFile(cfg)
+	if err != nil{
+		log.Fatal("While downloading the server file, the following error occurred: ", err)
+	}
+
+	localFile, err := ioutil.ReadFile(cfg.Keepass.ClientPath)
+	if err != nil{
+		log.Fatal(err)
+	}
+	credentials, err := s.CreateCredentials(cfg.Keepass.Password, cfg.Keepass.KeyFile)
+	if err != nil{
+		log.Fatal(err)
+	}
+
+	changes, err := s.CompareFiles(remoteFile, localFile, credentials)
+	if err != nil{
+		log.Fatal("While comparing the local file with the server file, the following error occurred: ", err)
+	}
+	log.Println("Dry run, the server file was not replaced.")
+	printChanges(changes, opts.JSON)
+}
+
+// downloads the file and its version from the server
+func downloadServerFile(cfg c.Config) ([]byte, string, error){
+	body, err := createGetRequestBody(cfg)
+	if err != nil{
+		return nil, "", err
+	}
+
+	payload, status, err := sendRequest(cfg, body, "GET", "/keepass")
+	if err != nil{
+		return nil, "", err
+	}
+	if status != http.StatusOK{
+		log.Fatal(status, " ", payload.Message)
+	}
+
+	file, err := base64.StdEncoding.DecodeString(payload.File)
+	return file, payload.Version, err
+}
+
+// uploads the merged file and returns the new version of the server file
+// the returned boolean is false if the server file doesn't have the given version anymore
+func uploadFile(cfg c.Config, file []byte, version string) (string, bool, error){
+	body, err := createUploadRequestBody(cfg, file, version, Options{})
+	if err != nil{
+		return "", false, err
+	}
+
+	payload, status, err := sendRequest(cfg, body, "PUT", "/keepass")
+	if err != nil{
+		return "", false, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return payload.Version, true, nil
+	case http.StatusConflict:
+		return "", false, nil
+	default:
+		log.Fatal(status, " ", payload.Message)
+		return "", false, nil
+	}
+}
+
+// returns the directory of the sync bases, without a configured directory the sync bases are next to the local file
+// returns an empty string if the sync base is disabled
+func syncBaseDirectory(cfg c.Config) string{
+	if cfg.Keepass.DisableSyncBase {
+		return ""
+	}
+	if cfg.Keepass.SyncBasePath != "" {
+		return cfg.Keepass.SyncBasePath
+	}
+	return filepath.Join(filepath.Dir(cfg.Keepass.ClientPath), "syncBases")
+}
+
+// returns the path of the last file which the client and the server had in common
+// the client keeps one sync base for every server
+func syncBasePath(cfg c.Config) string{
+	return filepath.Join(syncBaseDirectory(cfg), cfg.Server.Domain+"_"+cfg.Server.Port+".kdbx")
+}
+
+// loads the sync base of the end-to-end mode, returns nil if it is disabled or there is no sync base yet
+func loadSyncBase(cfg c.Config) []byte{
+	if syncBaseDirectory(cfg) == ""{
+		return nil
+	}
+
+	file, err := ioutil.ReadFile(syncBasePath(cfg))
+	if err != nil{
+		if !os.IsNotExist(err){
+			log.Println("The sync base could not be read: ", err)
+		}
+		return nil
+	}
+	return file
+}
+
+// saves the file which the client and the server have in common as the sync base for the next merge
+func saveSyncBase(cfg c.Config, file []byte){
+	directory := syncBaseDirectory(cfg)
+	if directory == ""{
+		return
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil{
+		log.Println("The directory for the sync base could not be created: ", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(syncBasePath(cfg), file, 0600); err != nil{
+		log.Println("The sync base could not be saved: ", err)
+	}
+}
+
+// saves the local file as the sync base after it was downloaded from or uploaded to the server
+func saveLocalFileAsSyncBase(cfg c.Config){
+	file, err := ioutil.ReadFile(cfg.Keepass.ClientPath)
+	if err != nil{
+		log.Println("The sync base could not be saved: ", err)
+		return
+	}
+	saveSyncBase(cfg, file)
+}
@@ -1,13 +1,8 @@
 package client
 
 import (
-	"bytes"
-	"crypto/ed25519"
-	"encoding/base64"
-	"encoding/json"
 	"io"
 	c "local-pass-sync/config"
-	k "local-pass-sync/key"
 	s "local-pass-sync/server"
 	"log"
 )
@@ -43,21 +38,28 @@ func HandlingGetRequest(cfg c.Config){
 
 	if !changed {
 		log.Println("There was no file on the server.")
+		return
+	}
+
+	// in the end-to-end mode the client keeps the sync base, because the server can't open the files
+	if cfg.Keepass.EndToEnd {
+		saveLocalFileAsSyncBase(cfg)
 	}
 }
 
-func createGetRequestBody(cfg c.Config) (*bytes.Reader, error){
-	privateKey, pubKey := k.GetPublicAndPrivateKey(cfg.Ed25519private.Path, cfg.Ed25519private.Password)
-	message := "get file from server"
+func createGetRequestBody(cfg c.Config) (s.Payload, error){
+	return createMessageRequestBody(cfg, "get file from server")
+}
 
-	payload := s.Payload{
-		Key: k.PublicKeyToString(pubKey),
-		File: "",
-		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(message))),
-		Message: message,
+// creates the payload with the message, it is signed by createRequest
+func createMessageRequestBody(cfg c.Config, message string) (s.Payload, error){
+	credentials, err := createCredentials(cfg)
+	if err != nil {
+		return s.Payload{}, err
 	}
 
-	payloadBytes, err := json.Marshal(payload)
-
-	return bytes.NewReader(payloadBytes), err
+	return s.Payload{
+		Message: message,
+		Credentials: credentials,
+	}, nil
 }
\ No newline at end of file
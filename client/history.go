@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	c "local-pass-sync/config"
+	k "local-pass-sync/key"
+	s "local-pass-sync/server"
+	"log"
+	"net/http"
+)
+
+// HandlingHistoryRequest prints the versions of the server file as text or as JSON
+func HandlingHistoryRequest(cfg c.Config, opts Options){
+	body, err := createMessageRequestBody(cfg, s.ListHistoryMessage)
+	if err != nil{
+		log.Fatal("While creating the request body with the keys, the following error occurred: ", err)
+	}
+
+	payload, status, err := sendRequest(cfg, body, "GET", "/keepass/history")
+	if err != nil{
+		log.Fatal("While requesting the history, the following error occurred: ", err)
+	}
+	if status != http.StatusOK{
+		log.Fatal(status, " ", payload.Message)
+	}
+	printVersions(payload.History, opts.JSON)
+}
+
+// HandlingRestoreRequest restores a version of the history on the server
+// the local file isn't changed, it gets the restored file with the next getFile or compareFiles
+func HandlingRestoreRequest(cfg c.Config, id string){
+	body, err := createMessageRequestBody(cfg, s.RestoreMessage+id)
+	if err != nil{
+		log.Fatal("While creating the request body with the keys, the following error occurred: ", err)
+	}
+
+	payload, status, err := sendRequest(cfg, body, "POST", "/keepass/history")
+	if err != nil{
+		log.Fatal("While restoring the version, the following error occurred: ", err)
+	}
+	if status != http.StatusOK{
+		log.Fatal(status, " ", payload.Message)
+	}
+	log.Println(payload.Message)
+}
+
+// prints the versions as text or as JSON on the standard output
+func printVersions(versions []s.FileVersion, jsonOutput bool){
+	if jsonOutput {
+		if versions == nil {
+			versions = []s.FileVersion{}
+		}
+		output, err := json.MarshalIndent(versions, "", "  ")
+		if err != nil{
+			log.Fatal(err)
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	if len(versions) == 0 {
+		fmt.Println("The server has no versions of the file.")
+		return
+	}
+	for _, version := range versions{
+		fmt.Println(formatVersion(version))
+	}
+}
+
+// formats a version as one line, the public key is shortened to a fingerprint
+func formatVersion(version s.FileVersion) string{
+	line := fmt.Sprintf("%s  %-8s", version.ID, version.Operation)
+	if version.Key != "" {
+		line += "  key " + k.Fingerprint(version.Key)
+	}
+	if version.Summary != "" {
+		line += "  " + version.Summary
+	}
+	return line
+}
@@ -7,8 +7,15 @@ import (
 )
 
 // HandlingPatchRequest uses the config to create the request and also handles the server response
-func HandlingPatchRequest(cfg c.Config){
-	body, err := createFileRequestBody(cfg)
+// the changes of the merge are printed as text or as JSON
+func HandlingPatchRequest(cfg c.Config, opts Options){
+	// in the end-to-end mode the server can't merge the files
+	if cfg.Keepass.EndToEnd {
+		handlingEndToEndCompare(cfg, opts)
+		return
+	}
+
+	body, err := createFileRequestBody(cfg, "", opts)
 	if err != nil{
 		log.Fatal("While creating the request body with the kdbx file and the keys," +
 			" the following error occurred: ", err)
@@ -30,9 +37,24 @@ func HandlingPatchRequest(cfg c.Config){
 		}
 	}(resp.Body)
 
-	if err, changed := handleResponse(cfg, resp); err != nil{
+	payload, err := readResponse(resp)
+	if err != nil{
+		log.Fatal("While handling the server response, the following error occurred: ", err)
+	}
+	printChanges(payload.Changes, opts.JSON)
+
+	// the server doesn't send a file for a dry run
+	if opts.DryRun{
+		return
+	}
+
+	err, changed := writeResponseFile(cfg, payload)
+	if err != nil{
 		log.Fatal("While handling the server response, the following error occurred: ", err)
-	} else if !changed{
+	}
+	// the local file has now the entries of the server file
+	saveVersion(cfg, payload.Version)
+	if !changed{
 		return
 	}
 
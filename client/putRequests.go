@@ -7,8 +7,15 @@ import (
 )
 
 // HandlingPutRequest uses the config to create the request and also handles the server response
-func HandlingPutRequest(cfg c.Config){
-	body, err := createFileRequestBody(cfg)
+// a dry run only prints the changes of the server file
+func HandlingPutRequest(cfg c.Config, opts Options){
+	// in the end-to-end mode the server can't compare the files
+	if opts.DryRun && cfg.Keepass.EndToEnd {
+		handlingEndToEndReplacementPreview(cfg, opts)
+		return
+	}
+
+	body, err := createFileRequestBody(cfg, loadVersion(cfg), opts)
 	if err != nil{
 		log.Fatal("While creating the request body with the kdbx file and the keys," +
 			" the following error occurred: ", err)
@@ -30,7 +37,21 @@ func HandlingPutRequest(cfg c.Config){
 		}
 	}(resp.Body)
 
+	if opts.DryRun {
+		payload, err := readResponse(resp)
+		if err != nil{
+			log.Fatal("While handling the server response, the following error occurred: ", err)
+		}
+		printChanges(payload.Changes, opts.JSON)
+		return
+	}
+
 	if err, _ := handleResponse(cfg, resp); err != nil{
 		log.Fatal("While handling the server response, the following error occurred: ", err)
 	}
+
+	// the server has now the local file
+	if cfg.Keepass.EndToEnd {
+		saveLocalFileAsSyncBase(cfg)
+	}
 }
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	m "local-pass-sync/merge"
+	"log"
+	"strings"
+)
+
+// prints the changes of a merge as text or as JSON on the standard output
+// the changes only contain the names of the changed fields, never their values
+func printChanges(changes []m.Change, jsonOutput bool){
+	if jsonOutput {
+		if changes == nil {
+			changes = []m.Change{}
+		}
+		output, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil{
+			log.Fatal(err)
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No entries were changed.")
+		return
+	}
+	for _, change := range changes{
+		fmt.Println(formatChange(change))
+	}
+}
+
+// formats a change as one line, e.g. "updated  Root/Mail/mail (local wins): UserName, Password"
+func formatChange(change m.Change) string{
+	line := fmt.Sprintf("%-9s %s/%s", change.Type, change.GroupPath, change.Title)
+	if change.Group {
+		line += " (group)"
+	}
+	if change.ConflictCopy {
+		line += " (conflict copy)"
+	}
+	switch change.Winner {
+	case "":
+		// the change isn't the result of a merge
+	case m.Both:
+		line += " (merged)"
+	default:
+		line += " (" + change.Winner + " wins)"
+	}
+	if len(change.Fields) > 0 {
+		line += ": " + strings.Join(change.Fields, ", ")
+	}
+	return line
+}
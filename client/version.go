@@ -0,0 +1,40 @@
+package client
+
+import (
+	"io/ioutil"
+	c "local-pass-sync/config"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the client remembers the version of the server file which it got last, the server only accepts a replacement
+// of its file with this version, so a client can't overwrite changes which it hasn't seen yet
+
+// returns the path of the file with the version, it is saved as hidden file next to the local file
+func versionPath(cfg c.Config) string{
+	return filepath.Join(filepath.Dir(cfg.Keepass.ClientPath), "."+filepath.Base(cfg.Keepass.ClientPath)+".version")
+}
+
+// returns the version of the server file which the client got last or an empty string if there is none
+func loadVersion(cfg c.Config) string{
+	version, err := ioutil.ReadFile(versionPath(cfg))
+	if err != nil{
+		if !os.IsNotExist(err){
+			log.Println("The version of the server file could not be read: ", err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(version))
+}
+
+// saves the version of the server file which the local file is based on
+func saveVersion(cfg c.Config, version string){
+	if version == "" {
+		return
+	}
+	if err := ioutil.WriteFile(versionPath(cfg), []byte(version+"\n"), 0600); err != nil{
+		log.Println("The version of the server file could not be saved: ", err)
+	}
+}
@@ -20,12 +20,26 @@ type Config struct {
 		Port 			   string
 		Domain			   string
 		AuthorizedKeysPath string `yaml:"authorized_keys_path"`
+		MaxClockSkewSeconds int `yaml:"max_clock_skew_seconds"`
 	}
 
 	Keepass struct{
 		Password	string
+		KeyFile     string `yaml:"key_file"`
+		ClientPassword string `yaml:"client_password"`
+		ClientKeyFile  string `yaml:"client_key_file"`
 		ServerPath  string `yaml:"server_path"`
 		ClientPath 	string `yaml:"client_path"`
+		SyncBasePath string `yaml:"sync_base_path"`
+		DisableSyncBase bool `yaml:"disable_sync_base"`
+		ConflictPolicy string `yaml:"conflict_policy"`
+		EmptyRecycleBinAfterDays int `yaml:"empty_recycle_bin_after_days"`
+		EndToEnd bool `yaml:"end_to_end"`
+		HistoryPath string `yaml:"history_path"`
+		HistoryMaxVersions int `yaml:"history_max_versions"`
+		HistoryMaxDays int `yaml:"history_max_days"`
+		BackupPath string `yaml:"backup_path"`
+		BackupCount int `yaml:"backup_count"`
 	}`yaml:"keepass"`
 
 	SslCertificate struct{
@@ -76,4 +90,24 @@ func addHomePath(cfg *Config) {
 	if strings.HasPrefix(cfg.Keepass.ServerPath, "~/") {
 		cfg.Keepass.ServerPath = filepath.Join(dir, cfg.Keepass.ServerPath[2:])
 	}
+
+	if strings.HasPrefix(cfg.Keepass.KeyFile, "~/") {
+		cfg.Keepass.KeyFile = filepath.Join(dir, cfg.Keepass.KeyFile[2:])
+	}
+
+	if strings.HasPrefix(cfg.Keepass.ClientKeyFile, "~/") {
+		cfg.Keepass.ClientKeyFile = filepath.Join(dir, cfg.Keepass.ClientKeyFile[2:])
+	}
+
+	if strings.HasPrefix(cfg.Keepass.BackupPath, "~/") {
+		cfg.Keepass.BackupPath = filepath.Join(dir, cfg.Keepass.BackupPath[2:])
+	}
+
+	if strings.HasPrefix(cfg.Keepass.HistoryPath, "~/") {
+		cfg.Keepass.HistoryPath = filepath.Join(dir, cfg.Keepass.HistoryPath[2:])
+	}
+
+	if strings.HasPrefix(cfg.Keepass.SyncBasePath, "~/") {
+		cfg.Keepass.SyncBasePath = filepath.Join(dir, cfg.Keepass.SyncBasePath[2:])
+	}
 }
\ No newline at end of file
@@ -1,9 +1,15 @@
 module local-pass-sync
 
-go 1.17
+go 1.22.0
 
 require (
-	github.com/tobischo/gokeepasslib v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+	github.com/tobischo/gokeepasslib/v3 v3.6.0
+	golang.org/x/crypto v0.22.0
+	golang.org/x/term v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/tobischo/argon2 v0.1.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
 )
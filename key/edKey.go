@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"golang.org/x/crypto/ssh"
@@ -133,3 +135,9 @@ func PublicKeyToString(key ed25519.PublicKey) string{
 	splitKey := strings.Split(pemEncodedPub, "\n")
 	return splitKey[1]
 }
+
+// Fingerprint returns a short name for a public key, which is the beginning of the sha256 hash of its string representation
+func Fingerprint(publicKey string) string{
+	hash := sha256.Sum256([]byte(publicKey))
+	return hex.EncodeToString(hash[:4])
+}
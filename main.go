@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"local-pass-sync/client"
 	c "local-pass-sync/config"
@@ -28,23 +29,63 @@ func main() {
 	case "server":
 		server.Serving(cfg)
 	case "compareFiles":
-		client.HandlingPatchRequest(cfg)
+		opts, _ := parseOptions(os.Args[2:])
+		client.HandlingPatchRequest(cfg, opts)
 	case "getFile":
 		client.HandlingGetRequest(cfg)
 	case "replaceFile":
-		client.HandlingPutRequest(cfg)
+		opts, _ := parseOptions(os.Args[2:])
+		client.HandlingPutRequest(cfg, opts)
+	case "diff":
+		opts, files := parseOptions(os.Args[2:])
+		if len(files) != 2 {
+			log.Fatal("The diff command needs two keepass files: diff [--json] [--password-stdin] [--key-file <path>] [--second-key-file <path>] <first.kdbx> <second.kdbx>")
+		}
+		client.HandlingDiff(opts, files[0], files[1])
+	case "history":
+		opts, _ := parseOptions(os.Args[2:])
+		client.HandlingHistoryRequest(cfg, opts)
+	case "restoreVersion":
+		if len(os.Args) < 3 {
+			log.Fatal("The restoreVersion command needs the id of a version, which is shown by the history command")
+		}
+		client.HandlingRestoreRequest(cfg, os.Args[2])
+	case "listBackups":
+		client.HandlingListBackups(cfg)
+	case "restoreLocal":
+		name := ""
+		if len(os.Args) > 2 {
+			name = os.Args[2]
+		}
+		client.HandlingRestoreLocal(cfg, name)
 	case "pubKey":
 		privateKey, _ := k.GetPublicAndPrivateKey(cfg.Ed25519private.Path, cfg.Ed25519private.Password)
 		if err := k.PrintPublicKey(privateKey); err != nil{
 			fmt.Println("While extracting the public from the private key the following error occurred: ", err)
 		}
 	case "help":
-		fmt.Println("Possible actions: \ncompareFiles\ngetFile\nreplaceFile")
+		fmt.Println("Possible actions: \ncompareFiles [--json] [--dry-run]\ngetFile\nreplaceFile [--json] [--dry-run] [--force]\ndiff [--json] [--password-stdin] [--key-file <path>] [--second-key-file <path>] <first.kdbx> <second.kdbx>\nhistory [--json]\nrestoreVersion <id>\nlistBackups\nrestoreLocal [backup]")
 	default:
 		fmt.Println("No such options")
 	}
 }
 
+// parses the options of a client command, e.g. "--json", and returns the remaining arguments
+func parseOptions(args []string) (client.Options, []string){
+	var opts client.Options
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.BoolVar(&opts.JSON, "json", false, "prints the changes as JSON")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "only prints the changes, the local and the server file stay untouched")
+	flags.BoolVar(&opts.Force, "force", false, "replaces the server file even if it was changed since the last sync")
+	flags.StringVar(&opts.KeyFile, "key-file", "", "the key file of the first file of diff")
+	flags.StringVar(&opts.SecondKeyFile, "second-key-file", "", "the key file of the second file of diff, the first credentials are used if it and the second password are empty")
+	flags.BoolVar(&opts.PasswordStdin, "password-stdin", false, "reads the passwords of diff from stdin, one per line, instead of a prompt")
+	if err := flags.Parse(args); err != nil{
+		log.Fatal(err)
+	}
+	return opts, flags.Args()
+}
+
 func loggingSetup(loggingPath string){
 	if loggingPath == ""{
 		return
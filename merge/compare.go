@@ -0,0 +1,127 @@
+package merge
+
+import (
+	"errors"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Compare returns the changes which turn the db before into the db after, e.g. if a file replaces another file
+// the entries are matched by their UUID and their fields by their name like in Merge, but both dbs are left untouched
+// the changes of the groups are listed before the changes of the entries and have no winner, because nothing is merged
+func Compare(before *gokeepasslib.Database, after *gokeepasslib.Database) ([]Change, error){
+	if before == nil || after == nil || !hasContent(before) || !hasContent(after) {
+		return nil, errors.New("both dbs need metadata and a root group for a comparison")
+	}
+
+	// the db after takes the role of the client and the db before the role of the server
+	c := &comparison{clientDb: after, serverDb: before, serverEntries: getMapForAllEntries(before)}
+	// the root groups are the same groups in both dbs, so only their sub-groups are compared
+	for _, root := range after.Content.Root.Groups{
+		c.compareGroups(root.Groups)
+	}
+	for _, group := range subGroups(before.Content.Root.Groups){
+		if findGroup(after.Content.Root.Groups, group.UUID) == nil {
+			c.changes = append(c.changes, newGroupChange(Deleted, group, before.Content.Root.Groups, nil))
+		}
+	}
+	c.compareEntries(after.Content.Root.Groups)
+
+	// the entries which are only in the db before were deleted
+	afterEntries := getMapForAllEntries(after)
+	for _, entry := range allEntries(before.Content.Root.Groups){
+		if _, ok := afterEntries[entry.UUID]; !ok {
+			c.changes = append(c.changes, newChange(Deleted, entry, before.Content.Root.Groups, "", nil))
+		}
+	}
+	return c.changes, nil
+}
+
+// loops through all groups and sub-groups recursively and compares them with the groups of the db before
+func (c *comparison) compareGroups(groups []gokeepasslib.Group){
+	afterGroups := c.clientDb.Content.Root.Groups
+	for _, group := range groups{
+		beforeGroup := findGroup(c.serverDb.Content.Root.Groups, group.UUID)
+		if beforeGroup == nil {
+			c.changes = append(c.changes, newGroupChange(Added, group, afterGroups, nil))
+			c.compareGroups(group.Groups)
+			continue
+		}
+
+		if fields := changedGroupFields(*beforeGroup, group); len(fields) > 0 {
+			c.changes = append(c.changes, newGroupChange(Updated, group, afterGroups, fields))
+		}
+		if !c.sameGroupLocation(group.UUID) {
+			c.changes = append(c.changes, newGroupChange(Moved, group, afterGroups, nil))
+		}
+		c.compareGroups(group.Groups)
+	}
+}
+
+// loops through all groups and sub-groups recursively and compares the entries of the db after with the entries of the db before
+func (c *comparison) compareEntries(groups []gokeepasslib.Group){
+	afterGroups := c.clientDb.Content.Root.Groups
+	for _, group := range groups{
+		for _, entry := range group.Entries{
+			beforeEntry, ok := c.serverEntries[entry.UUID]
+			if !ok {
+				c.changes = append(c.changes, newChange(Added, entry, afterGroups, "", nil))
+				continue
+			}
+
+			if fields := c.changedFields(beforeEntry, entry); len(fields) > 0 {
+				c.changes = append(c.changes, newChange(Updated, entry, afterGroups, "", fields))
+			}
+			if !c.sameLocation(entry.UUID) {
+				c.changes = append(c.changes, newChange(Moved, entry, afterGroups, "", nil))
+			}
+		}
+		c.compareEntries(group.Groups)
+	}
+}
+
+// checks if the entry is in the same group in both dbs
+// the root groups are the same group, even if their UUIDs are different
+func (c *comparison) sameLocation(uuid gokeepasslib.UUID) bool{
+	beforeParent := findParentGroup(c.serverDb.Content.Root.Groups, uuid)
+	afterParent := findParentGroup(c.clientDb.Content.Root.Groups, uuid)
+	if beforeParent == nil || afterParent == nil {
+		return beforeParent == afterParent
+	}
+	if beforeParent == &c.serverDb.Content.Root.Groups[0] && afterParent == &c.clientDb.Content.Root.Groups[0] {
+		return true
+	}
+	return beforeParent.UUID == afterParent.UUID
+}
+
+// checks if the group has the same parent group in both dbs, the root groups are the same group in both dbs
+func (c *comparison) sameGroupLocation(uuid gokeepasslib.UUID) bool{
+	beforeParent := findParentOfGroup(c.serverDb.Content.Root.Groups, uuid)
+	afterParent := findParentOfGroup(c.clientDb.Content.Root.Groups, uuid)
+	if beforeParent == nil || afterParent == nil {
+		return beforeParent == afterParent
+	}
+	if beforeParent == &c.serverDb.Content.Root.Groups[0] && afterParent == &c.clientDb.Content.Root.Groups[0] {
+		return true
+	}
+	return beforeParent.UUID == afterParent.UUID
+}
+
+// returns all sub-groups of the groups recursively in the order of the db, the given groups are not part of the result
+func subGroups(groups []gokeepasslib.Group) []gokeepasslib.Group{
+	var result []gokeepasslib.Group
+	for _, group := range groups{
+		result = append(result, group.Groups...)
+		result = append(result, subGroups(group.Groups)...)
+	}
+	return result
+}
+
+// returns all entries of the groups and sub-groups in the order of the db
+func allEntries(groups []gokeepasslib.Group) []gokeepasslib.Entry{
+	var entries []gokeepasslib.Entry
+	for _, group := range groups{
+		entries = append(entries, group.Entries...)
+		entries = append(entries, allEntries(group.Groups)...)
+	}
+	return entries
+}
@@ -0,0 +1,124 @@
+package merge
+
+import (
+	"github.com/tobischo/gokeepasslib/v3"
+	"sort"
+)
+
+// merges the history of the client entry and the server entry and writes it to the server entry
+// replaced server and client versions which aren't part of a history yet can be passed as additional entries
+// history entries are identified by their modification time, the result is trimmed with the history settings of the server db
+func (c *comparison) mergeHistories(serverEntry *gokeepasslib.Entry, serverVersions []gokeepasslib.Entry, clientEntry gokeepasslib.Entry, clientVersions []gokeepasslib.Entry){
+	history := make(map[int64]gokeepasslib.Entry)
+	for _, entry := range append(historyEntries(*serverEntry), serverVersions...){
+		history[historyKey(entry)] = entry
+	}
+
+	// the history of the client is tracked, to know if the client needs the merged history
+	clientHistory := make(map[int64]bool)
+	for _, entry := range historyEntries(clientEntry){
+		clientHistory[historyKey(entry)] = true
+	}
+
+	for _, entry := range append(historyEntries(clientEntry), clientVersions...){
+		key := historyKey(entry)
+		if _, ok := history[key]; ok {
+			continue
+		}
+		// the attachments of client versions have to be copied to the binaries of the server db
+		entry.Binaries = c.copyBinaries(entry)
+		history[key] = entry
+		c.fileModified = true
+	}
+
+	// the current version of an entry is never part of its own history
+	delete(history, historyKey(*serverEntry))
+
+	merged := make([]gokeepasslib.Entry, 0, len(history))
+	for _, entry := range history{
+		merged = append(merged, entry)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return historyKey(merged[i]) < historyKey(merged[j])
+	})
+	merged = trimHistory(merged, c.serverDb)
+
+	for _, entry := range merged{
+		if !clientHistory[historyKey(entry)] {
+			c.fileModified = true
+		}
+	}
+
+	if len(merged) == 0 {
+		serverEntry.Histories = nil
+		return
+	}
+	serverEntry.Histories = []gokeepasslib.History{{Entries: merged}}
+}
+
+// returns all history entries of an entry, keepass normally only uses one history element
+func historyEntries(entry gokeepasslib.Entry) []gokeepasslib.Entry{
+	var entries []gokeepasslib.Entry
+	for _, history := range entry.Histories{
+		entries = append(entries, history.Entries...)
+	}
+	return entries
+}
+
+// creates a copy of the entry which can be stored in the history of the entry
+// history entries don't have their own history
+func historySnapshot(entry gokeepasslib.Entry) gokeepasslib.Entry{
+	snapshot := entry
+	snapshot.Values = copyValues(entry.Values)
+	snapshot.Binaries = append([]gokeepasslib.BinaryReference(nil), entry.Binaries...)
+	snapshot.Times = copyTimes(entry.Times)
+	snapshot.Histories = nil
+	return snapshot
+}
+
+// history entries are identified by their modification time
+func historyKey(entry gokeepasslib.Entry) int64{
+	if entry.Times.LastModificationTime == nil{
+		return 0
+	}
+	return entry.Times.LastModificationTime.Time.UnixNano()
+}
+
+// removes the oldest history entries until the HistoryMaxItems and HistoryMaxSize settings of the db are fulfilled
+// a negative setting means that there is no limit, the history has to be sorted from old to new
+func trimHistory(history []gokeepasslib.Entry, db *gokeepasslib.Database) []gokeepasslib.Entry{
+	maxItems := db.Content.Meta.HistoryMaxItems
+	if maxItems >= 0 && int64(len(history)) > maxItems {
+		history = history[int64(len(history))-maxItems:]
+	}
+
+	maxSize := db.Content.Meta.HistoryMaxSize
+	if maxSize < 0 {
+		return history
+	}
+
+	var size int64
+	for _, entry := range history{
+		size += entrySize(entry, db)
+	}
+	for len(history) > 0 && size > maxSize {
+		size -= entrySize(history[0], db)
+		history = history[1:]
+	}
+	return history
+}
+
+// returns the approximate size of an entry in bytes, like keepass it counts the strings and the attachments
+func entrySize(entry gokeepasslib.Entry, db *gokeepasslib.Database) int64{
+	size := int64(len(entry.Tags) + len(entry.OverrideURL))
+	for _, value := range entry.Values{
+		size += int64(len(value.Key) + len(value.Value.Content))
+	}
+	for _, reference := range entry.Binaries{
+		size += int64(len(reference.Name))
+		if binary := findBinary(db, reference.Value.ID); binary != nil{
+			size += int64(len(binary.Content))
+		}
+	}
+	return size
+}
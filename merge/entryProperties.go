@@ -0,0 +1,75 @@
+package merge
+
+import (
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// copies the properties of an entry which aren't string fields or attachments,
+// these are the icons, colours, override URL, tags, expiry, AutoType settings and the custom data of plugins
+// the custom icon itself is merged with the metadata, so the server has the icon which the UUID references
+func copyEntryProperties(target *gokeepasslib.Entry, source gokeepasslib.Entry){
+	target.IconID = source.IconID
+	target.CustomIconUUID = source.CustomIconUUID
+	target.ForegroundColor = source.ForegroundColor
+	target.BackgroundColor = source.BackgroundColor
+	target.OverrideURL = source.OverrideURL
+	target.Tags = source.Tags
+	target.Times.Expires = source.Times.Expires
+	target.Times.ExpiryTime = copyTime(source.Times.ExpiryTime)
+
+	target.AutoType = source.AutoType
+	target.AutoType.Associations = append([]gokeepasslib.AutoTypeAssociation(nil), source.AutoType.Associations...)
+	target.CustomData = append([]gokeepasslib.CustomData(nil), source.CustomData...)
+}
+
+// checks if the properties which are copied by copyEntryProperties are the same for both entries
+func equalEntryProperties(a gokeepasslib.Entry, b gokeepasslib.Entry) bool{
+	return a.IconID == b.IconID &&
+		a.CustomIconUUID == b.CustomIconUUID &&
+		a.ForegroundColor == b.ForegroundColor &&
+		a.BackgroundColor == b.BackgroundColor &&
+		a.OverrideURL == b.OverrideURL &&
+		a.Tags == b.Tags &&
+		a.Times.Expires == b.Times.Expires &&
+		equalTime(a.Times.ExpiryTime, b.Times.ExpiryTime) &&
+		equalAutoType(a.AutoType, b.AutoType) &&
+		equalCustomData(a.CustomData, b.CustomData)
+}
+
+// two times are equal if both are missing or both describe the same instant
+func equalTime(a *w.TimeWrapper, b *w.TimeWrapper) bool{
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Time.Equal(b.Time)
+}
+
+// checks if both AutoType settings and their window associations are the same
+func equalAutoType(a gokeepasslib.AutoTypeData, b gokeepasslib.AutoTypeData) bool{
+	if a.Enabled != b.Enabled || a.DataTransferObfuscation != b.DataTransferObfuscation {
+		return false
+	}
+	if a.DefaultSequence != b.DefaultSequence || len(a.Associations) != len(b.Associations) {
+		return false
+	}
+	for i := range a.Associations {
+		if a.Associations[i] != b.Associations[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checks if both lists have the same custom data items, the order of the items doesn't matter
+func equalCustomData(a []gokeepasslib.CustomData, b []gokeepasslib.CustomData) bool{
+	if len(a) != len(b) {
+		return false
+	}
+	for _, item := range a {
+		if other := findCustomData(b, item.Key); other == nil || other.Value != item.Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package merge
+
+import (
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// compares the client group with the server group and creates, moves or changes the server group
+// the properties of the newer group are used and a group is moved if the client moved it after the server
+func (c *comparison) compareGroup(clientGroup gokeepasslib.Group, clientPath []gokeepasslib.Group){
+	// the root group of the client is always the root group of the server, even if the UUIDs are different
+	if len(clientPath) == 1 {
+		c.compareGroupProperties(&c.serverDb.Content.Root.Groups[0], clientGroup)
+		return
+	}
+
+	serverGroup := findGroup(c.serverDb.Content.Root.Groups, clientGroup.UUID)
+	if serverGroup == nil {
+		// a deleted group is only created again if it contains a newer entry, which is handled by createNewEntry
+		if !isDeleted(clientGroup.UUID, clientGroup.Times, c.deletedObjects){
+			findOrCreateGroupPath(c.serverDb, clientPath)
+		}
+		c.fileModified = true
+		return
+	}
+	c.compareGroupProperties(serverGroup, clientGroup)
+	c.compareGroupLocation(clientGroup, clientPath)
+}
+
+// sets the name, notes, icon and settings of the client group on the server group if the client group is newer
+func (c *comparison) compareGroupProperties(serverGroup *gokeepasslib.Group, clientGroup gokeepasslib.Group){
+	if equalGroupProperties(*serverGroup, clientGroup) {
+		return
+	}
+	// either the server group is changed or the client needs the newer server group
+	c.fileModified = true
+
+	if !isNewer(clientGroup.Times.LastModificationTime, serverGroup.Times.LastModificationTime) {
+		return
+	}
+	serverGroup.Name = clientGroup.Name
+	serverGroup.Notes = clientGroup.Notes
+	serverGroup.IconID = clientGroup.IconID
+	serverGroup.CustomIconUUID = clientGroup.CustomIconUUID
+	serverGroup.DefaultAutoTypeSequence = clientGroup.DefaultAutoTypeSequence
+	serverGroup.EnableAutoType = clientGroup.EnableAutoType
+	serverGroup.EnableSearching = clientGroup.EnableSearching
+	serverGroup.Times.LastModificationTime = copyTime(clientGroup.Times.LastModificationTime)
+}
+
+// checks if the properties of both groups are the same, the entries and sub-groups are not compared
+func equalGroupProperties(a gokeepasslib.Group, b gokeepasslib.Group) bool{
+	return a.Name == b.Name &&
+		a.Notes == b.Notes &&
+		a.IconID == b.IconID &&
+		a.CustomIconUUID == b.CustomIconUUID &&
+		a.DefaultAutoTypeSequence == b.DefaultAutoTypeSequence &&
+		a.EnableAutoType == b.EnableAutoType &&
+		a.EnableSearching == b.EnableSearching
+}
+
+// moves the server group into the parent group of the client, if the client moved the group after the server
+func (c *comparison) compareGroupLocation(clientGroup gokeepasslib.Group, clientPath []gokeepasslib.Group){
+	parentPath := clientPath[:len(clientPath)-1]
+	serverParent := findParentOfGroup(c.serverDb.Content.Root.Groups, clientGroup.UUID)
+	if serverParent == nil || c.isSameGroup(serverParent.UUID, parentPath) {
+		return
+	}
+	c.fileModified = true
+
+	serverGroup := findGroup(c.serverDb.Content.Root.Groups, clientGroup.UUID)
+	if !isNewer(clientGroup.Times.LocationChanged, serverGroup.Times.LocationChanged) {
+		return
+	}
+
+	// a group can't be moved into one of its own sub-groups, this happens if the server moved the groups the other way around
+	targetUUID := parentPath[len(parentPath)-1].UUID
+	if findGroup(serverGroup.Groups, targetUUID) != nil {
+		return
+	}
+
+	group := removeGroup(&c.serverDb.Content.Root.Groups, clientGroup.UUID)
+	group.Times.LocationChanged = copyTime(clientGroup.Times.LocationChanged)
+	target := findOrCreateGroupPath(c.serverDb, parentPath)
+	target.Groups = append(target.Groups, group)
+}
+
+// moves the server entry into the group of the client entry, if the client moved the entry after the server
+func (c *comparison) compareEntryLocation(clientEntry gokeepasslib.Entry, clientPath []gokeepasslib.Group){
+	serverParent := findParentGroup(c.serverDb.Content.Root.Groups, clientEntry.UUID)
+	// an entry without a parent group can't be moved, like a root group in compareGroupLocation
+	if serverParent == nil || c.isSameGroup(serverParent.UUID, clientPath) {
+		return
+	}
+	c.fileModified = true
+
+	serverEntry := findEntry(c.serverDb.Content.Root.Groups, clientEntry.UUID)
+	if !isNewer(clientEntry.Times.LocationChanged, serverEntry.Times.LocationChanged) {
+		c.report(Moved, *serverEntry, Remote, nil)
+		return
+	}
+
+	entry := removeEntry(serverParent, clientEntry.UUID)
+	entry.Times.LocationChanged = copyTime(clientEntry.Times.LocationChanged)
+	target := findOrCreateGroupPath(c.serverDb, clientPath)
+	target.Entries = append(target.Entries, entry)
+	c.report(Moved, entry, Local, nil)
+}
+
+// checks if the server group is the last group of the client path
+func (c *comparison) isSameGroup(serverGroupUUID gokeepasslib.UUID, clientPath []gokeepasslib.Group) bool{
+	if len(clientPath) == 1 {
+		return serverGroupUUID == c.serverDb.Content.Root.Groups[0].UUID
+	}
+	return serverGroupUUID == clientPath[len(clientPath)-1].UUID
+}
+
+// loops through all groups and sub-groups recursively and returns the parent group of the group with the given UUID
+// returns nil if the group is a root group or there is no such group
+func findParentOfGroup(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) *gokeepasslib.Group{
+	for i := range groups{
+		for _, group := range groups[i].Groups{
+			if group.UUID == uuid {
+				return &groups[i]
+			}
+		}
+		if parent := findParentOfGroup(groups[i].Groups, uuid); parent != nil{
+			return parent
+		}
+	}
+	return nil
+}
+
+// removes the group with the given UUID from the groups or sub-groups and returns the removed group
+func removeGroup(groups *[]gokeepasslib.Group, uuid gokeepasslib.UUID) gokeepasslib.Group{
+	for i := range *groups{
+		if (*groups)[i].UUID == uuid {
+			group := (*groups)[i]
+			*groups = append((*groups)[:i], (*groups)[i+1:]...)
+			return group
+		}
+	}
+	for i := range *groups{
+		if findGroup((*groups)[i].Groups, uuid) != nil{
+			return removeGroup(&(*groups)[i].Groups, uuid)
+		}
+	}
+	return gokeepasslib.Group{}
+}
+
+// removes the entry with the given UUID from the group and returns the removed entry
+func removeEntry(group *gokeepasslib.Group, uuid gokeepasslib.UUID) gokeepasslib.Entry{
+	for i, entry := range group.Entries{
+		if entry.UUID == uuid {
+			group.Entries = append(group.Entries[:i], group.Entries[i+1:]...)
+			return entry
+		}
+	}
+	return gokeepasslib.Entry{}
+}
+
+// checks if the time a is after the time b, a missing time is older than every other time
+func isNewer(a *w.TimeWrapper, b *w.TimeWrapper) bool{
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	return a.Time.After(b.Time)
+}
+
+// returns a copy of the time, so the server db doesn't share the time pointers with the client db
+func copyTime(t *w.TimeWrapper) *w.TimeWrapper{
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
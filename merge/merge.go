@@ -0,0 +1,570 @@
+// Package merge merges two keepass dbs entry by entry
+// it contains the rules which the server uses to merge the file of a client with the server file
+package merge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// creates a new key-value pair for an entry
+func mkValue(key string, value string) gokeepasslib.ValueData {
+	return gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value}}
+}
+
+// creates a new key-value pair for an entry which is protected
+// this should be used for passwords
+func mkProtectedValue(key string, value string) gokeepasslib.ValueData {
+	return gokeepasslib.ValueData{
+		Key:   key,
+		Value: gokeepasslib.V{Content: value, Protected: w.NewBoolWrapper(true)},
+	}
+}
+
+// Options configures how Merge solves differences between the local and the remote db
+type Options struct {
+	// Base is the remote db of the last sync, with it the entries are merged field by field
+	// without it the newer entry wins as a whole, it can be nil
+	Base *gokeepasslib.Database
+	// ConflictPolicy decides which field wins if both sides changed the same field since the base,
+	// an empty policy is handled like NewestWins
+	// without a base the changed fields of both sides can't be told apart, so the newer entry wins regardless of the policy
+	ConflictPolicy string
+	// LocalDevice and RemoteDevice are written into the conflict copies to show where the losing version comes from,
+	// they should be readable names (e.g. a short fingerprint of the key of the device)
+	LocalDevice  string
+	RemoteDevice string
+	// RemoteEntryDevices contains the devices which changed the entries of the remote db last,
+	// a conflict copy of a remote entry names this device instead of RemoteDevice, it can be nil
+	RemoteEntryDevices map[gokeepasslib.UUID]string
+	// EmptyRecycleBinAfter removes everything which is longer in the recycle bin of the remote db, 0 keeps the recycle bin
+	EmptyRecycleBinAfter time.Duration
+}
+
+// Result is the outcome of a merge
+type Result struct {
+	// Changed is true if the dbs were different, the merged remote db has to replace both files in this case
+	Changed bool
+	// Changes contains the changed entries without their values
+	Changes []Change
+	// Errors contains the problems which didn't stop the merge, e.g. attachments which are missing in the local db
+	Errors []error
+}
+
+// comparison contains the dbs and the state which is needed while the client db is compared with the server db
+// the local db of Merge is the client db and the remote db is the server db
+type comparison struct {
+	clientDb *gokeepasslib.Database
+	serverDb *gokeepasslib.Database
+	// baseDb is the last file the client got from the server, it is nil if the server doesn't know this file
+	baseDb *gokeepasslib.Database
+	// the names of both devices, they are used to mark conflict copies
+	clientDevice   string
+	serverDevice   string
+	conflictPolicy string
+	// the devices which changed the server entries last, an entry which is missing was changed by the server device
+	serverEntryDevices map[gokeepasslib.UUID]string
+
+	serverEntries  map[gokeepasslib.UUID]gokeepasslib.Entry
+	baseEntries    map[gokeepasslib.UUID]gokeepasslib.Entry
+	deletedObjects map[gokeepasslib.UUID]time.Time
+	fileModified   bool
+	changes        []Change
+	errors         []error
+}
+
+// Merge merges the local db into the remote db, both dbs have to be unlocked
+// only the remote db is changed, it contains the merged entries afterwards and the local db is left untouched
+// the local db can be a different device or file, the remote db is the common file of all devices (e.g. the server file)
+func Merge(local *gokeepasslib.Database, remote *gokeepasslib.Database, opts Options) (Result, error){
+	if err := validate(local, remote, opts); err != nil{
+		return Result{}, err
+	}
+
+	c := &comparison{
+		clientDb:           local,
+		serverDb:           remote,
+		baseDb:             opts.Base,
+		clientDevice:       opts.LocalDevice,
+		serverDevice:       opts.RemoteDevice,
+		conflictPolicy:     opts.ConflictPolicy,
+		serverEntryDevices: opts.RemoteEntryDevices,
+	}
+	if opts.Base != nil && !hasContent(opts.Base) {
+		c.baseDb = nil
+	}
+
+	// the recycle bin of the client has to be the same group as the recycle bin of the server
+	mapRecycleBin(local, remote)
+
+	// deletions have to be applied first, otherwise the deleted client entries would be added to the server again
+	c.deletedObjects = mergeDeletedObjects(local, remote, &c.fileModified)
+	c.removeDeletedGroupsAndEntries(&remote.Content.Root.Groups, true)
+
+	c.serverEntries = getMapForAllEntries(remote)
+	if c.baseDb != nil{
+		c.baseEntries = getMapForAllEntries(c.baseDb)
+	}
+	c.compareClientAndServerEntries(local.Content.Root.Groups, nil)
+	// the deleted entries are already removed, so the client is missing the other server entries and needs the merged db
+	clientEntries := getMapForAllEntries(local)
+	for _, entry := range allEntries(remote.Content.Root.Groups){
+		if _, ok := clientEntries[entry.UUID]; !ok {
+			c.fileModified = true
+		}
+	}
+	c.compareMetadata()
+
+	if opts.EmptyRecycleBinAfter > 0 {
+		c.emptyRecycleBin(opts.EmptyRecycleBinAfter)
+	}
+	// the report is created at the end, because the metadata and the recycle bin can modify the file as well
+	if c.fileModified {
+		c.reportServerOnlyEntries(remote.Content.Root.Groups, clientEntries)
+	}
+
+	return Result{Changed: c.fileModified, Changes: c.changes, Errors: c.errors}, nil
+}
+
+// checks if the dbs can be merged
+func validate(local *gokeepasslib.Database, remote *gokeepasslib.Database, opts Options) error{
+	if local == nil || remote == nil {
+		return errors.New("the local and the remote db are needed for a merge")
+	}
+	if !hasContent(local) || !hasContent(remote) {
+		return errors.New("the local and the remote db need metadata and a root group")
+	}
+
+	switch opts.ConflictPolicy {
+	case "", NewestWins, ServerWins, ClientWins, Duplicate:
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy %q", opts.ConflictPolicy)
+	}
+}
+
+// checks if the db has metadata and at least one root group
+func hasContent(db *gokeepasslib.Database) bool{
+	return db.Content != nil && db.Content.Meta != nil && db.Content.Root != nil && len(db.Content.Root.Groups) > 0
+}
+
+// combines the deleted objects (tombstones) of both dbs and writes them to the server db
+// if both dbs contain the same UUID the latest deletion time is used
+// returns a map with the UUID of the deleted object and the deletion time
+func mergeDeletedObjects(clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database, fileModified *bool) map[gokeepasslib.UUID]time.Time{
+	deletedObjects := make(map[gokeepasslib.UUID]time.Time)
+	for _, deletedObject := range serverDb.Content.Root.DeletedObjects{
+		deletedObjects[deletedObject.UUID] = deletionTime(deletedObject)
+	}
+
+	clientDeletedObjects := make(map[gokeepasslib.UUID]bool)
+	for _, clientDeletedObject := range clientDb.Content.Root.DeletedObjects{
+		clientDeletedObjects[clientDeletedObject.UUID] = true
+		clientDeletionTime := deletionTime(clientDeletedObject)
+
+		if serverDeletionTime, ok := deletedObjects[clientDeletedObject.UUID]; ok && !clientDeletionTime.After(serverDeletionTime){
+			continue
+		}
+		deletedObjects[clientDeletedObject.UUID] = clientDeletionTime
+		*fileModified = true
+	}
+
+	// the client has to get the tombstones which are only known by the server
+	if len(clientDeletedObjects) != len(deletedObjects){
+		*fileModified = true
+	}
+
+	serverDb.Content.Root.DeletedObjects = serverDb.Content.Root.DeletedObjects[:0]
+	for uuid, deletedAt := range deletedObjects{
+		deletionTimeWrapper := w.TimeWrapper{Time: deletedAt}
+		serverDb.Content.Root.DeletedObjects = append(serverDb.Content.Root.DeletedObjects, gokeepasslib.DeletedObjectData{
+			UUID:         uuid,
+			DeletionTime: &deletionTimeWrapper,
+		})
+	}
+	sort.Slice(serverDb.Content.Root.DeletedObjects, func(i, j int) bool {
+		a, b := serverDb.Content.Root.DeletedObjects[i], serverDb.Content.Root.DeletedObjects[j]
+		if !a.DeletionTime.Time.Equal(b.DeletionTime.Time){
+			return a.DeletionTime.Time.Before(b.DeletionTime.Time)
+		}
+		return bytes.Compare(a.UUID[:], b.UUID[:]) < 0
+	})
+
+	return deletedObjects
+}
+
+// returns the deletion time of the tombstone, a missing time is treated as the zero time,
+// so the tombstone never removes an entry which has a modification time
+func deletionTime(deletedObject gokeepasslib.DeletedObjectData) time.Time{
+	if deletedObject.DeletionTime == nil{
+		return time.Time{}
+	}
+	return deletedObject.DeletionTime.Time
+}
+
+// checks if the object with the UUID was deleted after its last modification
+// an entry or group which was changed after the deletion on another device is kept
+func isDeleted(uuid gokeepasslib.UUID, times gokeepasslib.TimeData, deletedObjects map[gokeepasslib.UUID]time.Time) bool{
+	deletedAt, ok := deletedObjects[uuid]
+	if !ok {
+		return false
+	}
+	if times.LastModificationTime == nil{
+		return true
+	}
+	return !times.LastModificationTime.Time.After(deletedAt)
+}
+
+// loops through all groups and sub-groups recursively and removes the deleted entries and groups
+// a deleted group is only removed if all of its entries and sub-groups were removed as well,
+// the root groups are never removed
+func (c *comparison) removeDeletedGroupsAndEntries(groups *[]gokeepasslib.Group, isRoot bool){
+	keptGroups := (*groups)[:0]
+	for _, group := range *groups{
+		keptEntries := group.Entries[:0]
+		for _, entry := range group.Entries{
+			if isDeleted(entry.UUID, entry.Times, c.deletedObjects){
+				c.fileModified = true
+				c.reportDeletion(entry)
+				continue
+			}
+			keptEntries = append(keptEntries, entry)
+		}
+		group.Entries = keptEntries
+
+		c.removeDeletedGroupsAndEntries(&group.Groups, false)
+
+		if !isRoot && len(group.Entries) == 0 && len(group.Groups) == 0 && isDeleted(group.UUID, group.Times, c.deletedObjects){
+			c.fileModified = true
+			continue
+		}
+		keptGroups = append(keptGroups, group)
+	}
+	*groups = keptGroups
+}
+
+// returns a map of all entries in the db
+func getMapForAllEntries(db *gokeepasslib.Database) map[gokeepasslib.UUID] gokeepasslib.Entry{
+	m := make(map[gokeepasslib.UUID]gokeepasslib.Entry)
+	iterateGroup(db.Content.Root.Groups, db, m)
+	return m
+}
+
+// loops through all groups and sub-groups recursively and gathers all entries
+func iterateGroup(group []gokeepasslib.Group, db *gokeepasslib.Database, m map[gokeepasslib.UUID] gokeepasslib.Entry){
+	for _, element := range group{
+		for _, entry := range element.Entries{
+			m[entry.UUID] = entry
+		}
+		iterateGroup(element.Groups, db, m)
+	}
+}
+
+//  loops through all groups and sub-groups recursively and compares the groups and entries with a given map
+// the group path contains all parent groups of the client group, so new entries can be placed in the same group on the server
+// entries which were deleted after their last modification on the client are not added to the server again
+func (c *comparison) compareClientAndServerEntries(clientGroup []gokeepasslib.Group, groupPath []gokeepasslib.Group){
+	for _, clientElement := range clientGroup{
+		// copying the path, otherwise the sibling groups would share the same underlying array
+		clientPath := append(append([]gokeepasslib.Group{}, groupPath...), clientElement)
+		c.compareGroup(clientElement, clientPath)
+
+		for _, clientEntry := range clientElement.Entries{
+			if isDeleted(clientEntry.UUID, clientEntry.Times, c.deletedObjects){
+				// the client still has the entry, so it needs the new file without it
+				// an entry which was deleted by the client itself was already reported when it was removed from the server
+				if !hasDeletedObject(c.clientDb, clientEntry.UUID) {
+					c.report(Deleted, clientEntry, Remote, nil)
+				}
+				c.fileModified = true
+				continue
+			}
+
+			// checks if the entries from the client are in the server file
+			if _, ok := c.serverEntries[clientEntry.UUID]; !ok {
+				// add the entry to the server file if it doesnt exits
+				c.createNewEntry(clientEntry, clientPath)
+				continue
+			}
+
+			c.compareEntryLocation(clientEntry, clientPath)
+
+			// the entry is searched in the db, because the map only contains copies of the server entries
+			// and the entry might have been moved to another group
+			serverEntry := findEntry(c.serverDb.Content.Root.Groups, clientEntry.UUID)
+			if baseEntry, ok := c.baseEntries[clientEntry.UUID]; ok {
+				c.mergeWithBase(serverEntry, clientEntry, baseEntry)
+			} else {
+				c.compareLastModificationTime(serverEntry, clientEntry)
+			}
+		}
+		c.compareClientAndServerEntries(clientElement.Groups, clientPath)
+	}
+}
+
+// changes the server entry if the client has a newer version of this entry
+// this is used if the server doesn't know which version of the entry the client had before
+func (c *comparison) compareLastModificationTime(serverEntry *gokeepasslib.Entry, clientEntry gokeepasslib.Entry){
+	fields := c.changedFields(*serverEntry, clientEntry)
+	if clientEntry.Times.LastModificationTime.Time.After(serverEntry.Times.LastModificationTime.Time) {
+		// the current server version is kept in the history of the entry, so it can be restored later
+		replacedEntry := historySnapshot(*serverEntry)
+
+		// change ServerEntry, all string fields of the client are taken over,
+		// so fields which were added or removed on the client are also added or removed on the server
+		updateValues(serverEntry, clientEntry)
+		serverEntry.Binaries = c.copyBinaries(clientEntry)
+		copyEntryProperties(serverEntry, clientEntry)
+
+		*serverEntry.Times.LastModificationTime = *clientEntry.Times.LastModificationTime
+		c.fileModified = true
+		if len(fields) > 0 {
+			c.report(Updated, *serverEntry, Local, fields)
+		}
+
+		c.mergeHistories(serverEntry, []gokeepasslib.Entry{replacedEntry}, clientEntry, nil)
+	} else if serverEntry.Times.LastModificationTime.Time.After(clientEntry.Times.LastModificationTime.Time)  {
+		// we dont need to change something if a newer version of an entry is on the server because we are returning the server file
+		// but we have to know that the client needs a new version
+		c.fileModified = true
+		if len(fields) > 0 {
+			c.report(Updated, *serverEntry, Remote, fields)
+		}
+
+		// the older client version is added to the history, in case the client version was never sent to the server
+		c.mergeHistories(serverEntry, nil, clientEntry, []gokeepasslib.Entry{historySnapshot(clientEntry)})
+	} else {
+		c.mergeHistories(serverEntry, nil, clientEntry, nil)
+	}
+}
+
+// creates a new gokeepasslib entry with the client entry values and writes it to the given server db
+// the entry is placed in the server group which matches the group path of the client
+// the UUID and times of the client entry are kept, otherwise the next comparison wouldn't find the entry on the server
+func (c *comparison) createNewEntry(clientEntry gokeepasslib.Entry, clientPath []gokeepasslib.Group){
+	entry := gokeepasslib.Entry{
+		UUID:  clientEntry.UUID,
+		Times: copyTimes(clientEntry.Times),
+	}
+	entry.Values = copyValues(clientEntry.Values)
+	entry.Binaries = c.copyBinaries(clientEntry)
+	copyEntryProperties(&entry, clientEntry)
+
+	var history []gokeepasslib.Entry
+	for _, historyEntry := range historyEntries(clientEntry){
+		historyEntry = historySnapshot(historyEntry)
+		historyEntry.Binaries = c.copyBinaries(historyEntry)
+		history = append(history, historyEntry)
+	}
+	if len(history) > 0 {
+		entry.Histories = []gokeepasslib.History{{Entries: history}}
+	}
+
+	serverGroup := findOrCreateGroupPath(c.serverDb, clientPath)
+	serverGroup.Entries = append(serverGroup.Entries, entry)
+	c.fileModified = true
+	c.report(Added, entry, Local, nil)
+}
+
+// copies all string fields of an entry, including the custom fields (e.g. TOTP seeds or PINs)
+// the protected flag of each field is kept, so protected fields are encrypted again when the db is locked
+func copyValues(values []gokeepasslib.ValueData) []gokeepasslib.ValueData{
+	copied := make([]gokeepasslib.ValueData, len(values))
+	copy(copied, values)
+	return copied
+}
+
+// sets the string fields of the client entry on the server entry
+// the fields are matched by their name, because the order of the fields can be different in both files,
+// fields which are missing on the server are appended and fields which aren't on the client anymore are removed
+func updateValues(serverEntry *gokeepasslib.Entry, clientEntry gokeepasslib.Entry){
+	var values []gokeepasslib.ValueData
+	for _, serverValue := range serverEntry.Values{
+		if clientValue := clientEntry.Get(serverValue.Key); clientValue != nil{
+			values = append(values, *clientValue)
+		}
+	}
+	for _, clientValue := range clientEntry.Values{
+		if serverEntry.Get(clientValue.Key) == nil{
+			values = append(values, clientValue)
+		}
+	}
+	serverEntry.Values = values
+}
+
+// copies the attachments of the client entry into the binaries of the server db
+// identical attachments are stored only once, the returned references point to the server binaries
+// attachments which can't be copied are skipped and collected in the errors of the comparison
+func (c *comparison) copyBinaries(clientEntry gokeepasslib.Entry) []gokeepasslib.BinaryReference{
+	var references []gokeepasslib.BinaryReference
+	for _, reference := range clientEntry.Binaries{
+		clientBinary := findBinary(c.clientDb, reference.Value.ID)
+		if clientBinary == nil{
+			c.errors = append(c.errors, fmt.Errorf("the attachment %s of the entry %s is missing in the client file", reference.Name, clientEntry.GetTitle()))
+			continue
+		}
+
+		content, err := binaryContent(c.clientDb, *clientBinary)
+		if err != nil{
+			c.errors = append(c.errors, fmt.Errorf("the attachment %s of the entry %s could not be read: %s", reference.Name, clientEntry.GetTitle(), err))
+			continue
+		}
+
+		serverBinary := findOrAddBinary(c.serverDb, content)
+		references = append(references, serverBinary.CreateReference(reference.Name))
+	}
+	return references
+}
+
+// returns the server binary with the same content or adds a new binary if there is none
+func findOrAddBinary(serverDb *gokeepasslib.Database, content []byte) *gokeepasslib.Binary{
+	serverBinaries := *binaries(serverDb)
+	for i := range serverBinaries{
+		serverContent, err := binaryContent(serverDb, serverBinaries[i])
+		if err != nil{
+			continue
+		}
+		if bytes.Equal(serverContent, content){
+			return &serverBinaries[i]
+		}
+	}
+	return serverDb.AddBinary(content)
+}
+
+// returns the binaries of the db, kdbx 4 files store them in the inner header and kdbx 3.1 files in the metadata
+func binaries(db *gokeepasslib.Database) *gokeepasslib.Binaries{
+	if db.Header != nil && db.Header.IsKdbx4() && db.Content.InnerHeader != nil{
+		return &db.Content.InnerHeader.Binaries
+	}
+	return &db.Content.Meta.Binaries
+}
+
+// returns the binary of the db with the ID or nil if there is none
+func findBinary(db *gokeepasslib.Database, id int) *gokeepasslib.Binary{
+	return binaries(db).Find(id)
+}
+
+// returns the decoded and decompressed content of a binary of the db
+// Binary.GetContentBytes is not used, because it keeps the padding of the base64 buffer for uncompressed binaries
+// and tries to decode the raw content of kdbx 4 binaries as base64 as well
+func binaryContent(db *gokeepasslib.Database, binary gokeepasslib.Binary) ([]byte, error){
+	decoded := binary.Content
+	// only kdbx 3.1 stores the binaries as base64 in the xml
+	if db.Header == nil || !db.Header.IsKdbx4(){
+		var err error
+		if decoded, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(binary.Content))); err != nil{
+			return nil, err
+		}
+	}
+	if !binary.Compressed.Bool{
+		return decoded, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(decoded))
+	if err != nil{
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// loops through all groups and sub-groups recursively and returns the entry with the given UUID
+// returns nil if there is no such entry
+func findEntry(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) *gokeepasslib.Entry{
+	for i := range groups{
+		for j := range groups[i].Entries{
+			if groups[i].Entries[j].UUID == uuid {
+				return &groups[i].Entries[j]
+			}
+		}
+		if entry := findEntry(groups[i].Groups, uuid); entry != nil{
+			return entry
+		}
+	}
+	return nil
+}
+
+// returns the server group which matches the last group of the client path
+// groups are found by their UUID, missing groups are created below the previous group of the path
+func findOrCreateGroupPath(serverDb *gokeepasslib.Database, clientPath []gokeepasslib.Group) *gokeepasslib.Group{
+	// the root group of the client is always the root group of the server, even if the UUIDs are different
+	serverGroup := &serverDb.Content.Root.Groups[0]
+	for _, clientGroup := range clientPath[1:]{
+		if group := findGroup(serverDb.Content.Root.Groups, clientGroup.UUID); group != nil{
+			serverGroup = group
+			continue
+		}
+		serverGroup.Groups = append(serverGroup.Groups, copyGroup(clientGroup))
+		serverGroup = &serverGroup.Groups[len(serverGroup.Groups)-1]
+	}
+	return serverGroup
+}
+
+// loops through all groups and sub-groups recursively and returns the group which contains the entry with the given UUID
+// returns nil if there is no such entry
+func findParentGroup(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) *gokeepasslib.Group{
+	for i := range groups{
+		for _, entry := range groups[i].Entries{
+			if entry.UUID == uuid {
+				return &groups[i]
+			}
+		}
+		if group := findParentGroup(groups[i].Groups, uuid); group != nil{
+			return group
+		}
+	}
+	return nil
+}
+
+// loops through all groups and sub-groups recursively and returns the group with the given UUID
+// returns nil if there is no such group
+func findGroup(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) *gokeepasslib.Group{
+	for i := range groups{
+		if groups[i].UUID == uuid {
+			return &groups[i]
+		}
+		if group := findGroup(groups[i].Groups, uuid); group != nil{
+			return group
+		}
+	}
+	return nil
+}
+
+// creates an empty copy of the group with the same UUID, name, notes, icon and times
+// the entries and sub-groups are not copied
+func copyGroup(group gokeepasslib.Group) gokeepasslib.Group{
+	return gokeepasslib.Group{
+		UUID:                    group.UUID,
+		Name:                    group.Name,
+		Notes:                   group.Notes,
+		IconID:                  group.IconID,
+		CustomIconUUID:          group.CustomIconUUID,
+		Times:                   copyTimes(group.Times),
+		IsExpanded:              group.IsExpanded,
+		DefaultAutoTypeSequence: group.DefaultAutoTypeSequence,
+		EnableAutoType:          group.EnableAutoType,
+		EnableSearching:         group.EnableSearching,
+	}
+}
+
+// copies the time data, so the server db doesn't share the time pointers with the client db
+func copyTimes(times gokeepasslib.TimeData) gokeepasslib.TimeData{
+	copied := times
+	for _, t := range []**w.TimeWrapper{&copied.CreationTime, &copied.LastModificationTime,
+		&copied.LastAccessTime, &copied.ExpiryTime, &copied.LocationChanged}{
+		if *t != nil{
+			value := **t
+			*t = &value
+		}
+	}
+	return copied
+}
@@ -0,0 +1,912 @@
+package merge
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+const testPassword = "abcdefg12345678"
+
+// unlocks a kdbx file from the testdata directory, which has the fixtures of the client and the server file
+func openTestDatabase(t *testing.T, name string) *gokeepasslib.Database {
+	file, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = gokeepasslib.NewPasswordCredentials(testPassword)
+	if err := gokeepasslib.NewDecoder(bytes.NewReader(file)).Decode(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UnlockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// merges the dbs and fails the test if the merge returns an error
+func mergeDatabases(t *testing.T, local *gokeepasslib.Database, remote *gokeepasslib.Database, opts Options) Result {
+	result, err := Merge(local, remote, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// both fixtures contain the same entry, but the client orders its fields differently and has a newer version of it
+func TestMergeUpdatesFieldsByName(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{}).Changed {
+		t.Fatal("expected the server file to be modified")
+	}
+
+	serverEntry := serverDb.Content.Root.Groups[0].Entries[0]
+	expected := map[string]string{
+		"Notes":    "",
+		"Title":    "mail",
+		"URL":      "https://mail.example.com",
+		"UserName": "alice@example.com",
+		"Password": "new-password",
+		"PIN":      "1234",
+	}
+	if len(serverEntry.Values) != len(expected) {
+		t.Errorf("expected %d fields, got %d", len(expected), len(serverEntry.Values))
+	}
+	for key, value := range expected {
+		if content := serverEntry.GetContent(key); content != value {
+			t.Errorf("field %s: expected %q, got %q", key, value, content)
+		}
+	}
+
+	// the server keeps its own order and appends the new fields
+	if serverEntry.Values[0].Key != "Notes" || serverEntry.Values[len(serverEntry.Values)-1].Key != "PIN" {
+		t.Errorf("unexpected field order: %v", serverEntry.Values)
+	}
+	if !serverEntry.Get("PIN").Value.Protected.Bool {
+		t.Error("expected the PIN field to stay protected")
+	}
+}
+
+func TestMergeKeepsReplacedVersionInHistory(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	history := historyEntries(serverDb.Content.Root.Groups[0].Entries[0])
+	if len(history) != 1 {
+		t.Fatalf("expected 1 history entry, got %d", len(history))
+	}
+	if password := history[0].GetPassword(); password != "old-password" {
+		t.Errorf("expected the replaced password in the history, got %q", password)
+	}
+}
+
+// both devices have their own versions in the history of the entry, the merged history contains all of them sorted by time
+func TestMergeMergesInterleavedHistories(t *testing.T) {
+	entry := newTestEntry("mail", testModificationTime)
+	version := func(hoursAgo int) gokeepasslib.Entry {
+		snapshot := historySnapshot(entry)
+		modificationTime := w.TimeWrapper{Time: testModificationTime.Add(-time.Duration(hoursAgo) * time.Hour)}
+		snapshot.Times.LastModificationTime = &modificationTime
+		return snapshot
+	}
+	serverEntry := historySnapshot(entry)
+	serverEntry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{version(4), version(2)}}}
+	clientEntry := historySnapshot(entry)
+	clientEntry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{version(3), version(1)}}}
+	serverDb := newTestDatabase(serverEntry)
+	clientDb := newTestDatabase(clientEntry)
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{}).Changed {
+		t.Error("expected the merged history to modify the file")
+	}
+
+	history := historyEntries(serverDb.Content.Root.Groups[0].Entries[0])
+	if len(history) != 4 {
+		t.Fatalf("expected the 4 versions of both devices, got %d", len(history))
+	}
+	for i, hoursAgo := range []int{4, 3, 2, 1} {
+		if historyKey(history[i]) != historyKey(version(hoursAgo)) {
+			t.Errorf("history entry %d: expected the version of %d hours ago, got %v", i, hoursAgo, history[i].Times.LastModificationTime.Time)
+		}
+	}
+}
+
+// the oldest history entries are removed until the history settings of the db are fulfilled
+func TestTrimHistory(t *testing.T) {
+	db := newTestDatabase()
+	var history []gokeepasslib.Entry
+	for i := 0; i < 4; i++ {
+		history = append(history, newTestEntry("mail", testModificationTime.Add(time.Duration(i)*time.Hour)))
+	}
+	entrySizeInBytes := entrySize(history[0], db)
+
+	tests := []struct {
+		name     string
+		maxItems int64
+		maxSize  int64
+		expected int
+	}{
+		{"no limits", -1, -1, 4},
+		{"max items", 2, -1, 2},
+		{"max size", -1, 3 * entrySizeInBytes, 3},
+		{"max size below one entry", -1, entrySizeInBytes - 1, 0},
+		{"both limits", 3, 2 * entrySizeInBytes, 2},
+	}
+	for _, test := range tests {
+		db.Content.Meta.HistoryMaxItems = test.maxItems
+		db.Content.Meta.HistoryMaxSize = test.maxSize
+
+		trimmed := trimHistory(history, db)
+
+		if len(trimmed) != test.expected {
+			t.Errorf("%s: expected %d history entries, got %d", test.name, test.expected, len(trimmed))
+			continue
+		}
+		// the newest entries are kept
+		if test.expected > 0 && historyKey(trimmed[len(trimmed)-1]) != historyKey(history[len(history)-1]) {
+			t.Errorf("%s: expected the newest history entry to be kept", test.name)
+		}
+	}
+}
+
+// the client changed the password and the server changed the URL of the same entry since the last sync
+func TestMergeMergesFieldsWithSyncBase(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	baseDb := openTestDatabase(t, "server.kdbx")
+
+	serverEntry := &serverDb.Content.Root.Groups[0].Entries[0]
+	serverEntry.Get("URL").Value.Content = "https://new-mail.example.com"
+	modificationTime := w.TimeWrapper{Time: clientDb.Content.Root.Groups[0].Entries[0].Times.LastModificationTime.Time.Add(time.Hour)}
+	serverEntry.Times.LastModificationTime = &modificationTime
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{Base: baseDb}).Changed {
+		t.Fatal("expected the server file to be modified")
+	}
+
+	expected := map[string]string{
+		"URL":      "https://new-mail.example.com",
+		"UserName": "alice@example.com",
+		"Password": "new-password",
+		"PIN":      "1234",
+	}
+	for key, value := range expected {
+		if content := serverEntry.GetContent(key); content != value {
+			t.Errorf("field %s: expected %q, got %q", key, value, content)
+		}
+	}
+}
+
+func TestMergeDuplicatesConflicts(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	baseDb := openTestDatabase(t, "server.kdbx")
+
+	// the server changed the password as well and is newer than the client
+	serverEntry := &serverDb.Content.Root.Groups[0].Entries[0]
+	serverEntry.Get("Password").Value.Content = "server-password"
+	modificationTime := w.TimeWrapper{Time: clientDb.Content.Root.Groups[0].Entries[0].Times.LastModificationTime.Time.Add(time.Hour)}
+	serverEntry.Times.LastModificationTime = &modificationTime
+
+	result := mergeDatabases(t, clientDb, serverDb, Options{Base: baseDb, ConflictPolicy: Duplicate, LocalDevice: "clientKey"})
+
+	entries := serverDb.Content.Root.Groups[0].Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected the merged entry and the conflict copy, got %d entries", len(entries))
+	}
+	if password := entries[0].GetPassword(); password != "server-password" {
+		t.Errorf("expected the newer server password, got %q", password)
+	}
+
+	conflictCopy := entries[1]
+	if conflictCopy.GetTitle() != "mail (conflict)" || conflictCopy.Tags != "conflict" {
+		t.Errorf("unexpected title %q or tags %q of the conflict copy", conflictCopy.GetTitle(), conflictCopy.Tags)
+	}
+	if conflictCopy.GetPassword() != "new-password" || conflictCopy.GetContent("ConflictDevice") != "clientKey" {
+		t.Errorf("expected the client version in the conflict copy, got %v", conflictCopy.Values)
+	}
+	// the copy is reported as an added entry with the losing client version
+	expected := Change{Type: Added, UUID: hex.EncodeToString(conflictCopy.UUID[:]), Title: "mail (conflict)", GroupPath: "Root", Winner: Local, ConflictCopy: true}
+	if last := result.Changes[len(result.Changes)-1]; !reflect.DeepEqual(last, expected) {
+		t.Errorf("expected the conflict copy to be reported as %+v, got %+v", expected, last)
+	}
+}
+
+// the client is newer and wins, the conflict copy names the key which changed the server version last
+func TestMergeNamesTheDeviceOfServerConflictCopies(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	baseDb := openTestDatabase(t, "server.kdbx")
+
+	serverEntry := &serverDb.Content.Root.Groups[0].Entries[0]
+	serverEntry.Get("Password").Value.Content = "server-password"
+	devices := map[gokeepasslib.UUID]string{serverEntry.UUID: "key otherKey"}
+
+	result := mergeDatabases(t, clientDb, serverDb, Options{Base: baseDb, ConflictPolicy: Duplicate, RemoteDevice: "server", RemoteEntryDevices: devices})
+
+	entries := serverDb.Content.Root.Groups[0].Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected the merged entry and the conflict copy, got %d entries", len(entries))
+	}
+	conflictCopy := entries[1]
+	if conflictCopy.GetPassword() != "server-password" || conflictCopy.GetContent("ConflictDevice") != "key otherKey" {
+		t.Errorf("expected the server version of otherKey in the conflict copy, got %v", conflictCopy.Values)
+	}
+	last := result.Changes[len(result.Changes)-1]
+	if last.Type != Added || !last.ConflictCopy || last.Winner != Remote {
+		t.Errorf("expected the conflict copy to be reported as added with the remote version, got %+v", last)
+	}
+}
+
+func TestMergeMovesEntries(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	// the client moved the entry into a new group
+	clientRoot := &clientDb.Content.Root.Groups[0]
+	group := gokeepasslib.NewGroup()
+	group.Name = "Work"
+	group.Entries = clientRoot.Entries
+	now := w.Now()
+	group.Entries[0].Times.LocationChanged = &now
+	clientRoot.Entries = nil
+	clientRoot.Groups = append(clientRoot.Groups, group)
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	serverRoot := serverDb.Content.Root.Groups[0]
+	if len(serverRoot.Entries) != 0 || len(serverRoot.Groups) != 1 {
+		t.Fatalf("expected the entry to be moved, got %d entries and %d groups", len(serverRoot.Entries), len(serverRoot.Groups))
+	}
+	if serverRoot.Groups[0].Name != "Work" || len(serverRoot.Groups[0].Entries) != 1 {
+		t.Errorf("expected the entry in the group Work, got %+v", serverRoot.Groups[0])
+	}
+}
+
+// a new entry of the client in a nested group creates the same groups on the server
+func TestMergeCreatesGroupPathOfNewEntries(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	work := gokeepasslib.NewGroup()
+	work.Name = "Work"
+	work.IconID = 7
+	projects := gokeepasslib.NewGroup()
+	projects.Name = "Projects"
+	projects.IconID = 12
+	entry := gokeepasslib.NewEntry()
+	entry.Values = []gokeepasslib.ValueData{mkValue("Title", "ci"), mkProtectedValue("Password", "token")}
+	projects.Entries = []gokeepasslib.Entry{entry}
+	work.Groups = []gokeepasslib.Group{projects}
+	clientRoot := &clientDb.Content.Root.Groups[0]
+	clientRoot.Groups = append(clientRoot.Groups, work)
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{}).Changed {
+		t.Fatal("expected the new entry to modify the server file")
+	}
+
+	serverRoot := serverDb.Content.Root.Groups[0]
+	if len(serverRoot.Groups) != 1 {
+		t.Fatalf("expected the group Work on the server, got %d groups", len(serverRoot.Groups))
+	}
+	serverWork := serverRoot.Groups[0]
+	if serverWork.UUID != work.UUID || serverWork.Name != "Work" || serverWork.IconID != 7 || len(serverWork.Groups) != 1 {
+		t.Fatalf("expected the group Work of the client, got %+v", serverWork)
+	}
+	serverProjects := serverWork.Groups[0]
+	if serverProjects.UUID != projects.UUID || serverProjects.Name != "Projects" || serverProjects.IconID != 12 {
+		t.Errorf("expected the group Projects of the client, got %+v", serverProjects)
+	}
+	if len(serverProjects.Entries) != 1 || serverProjects.Entries[0].UUID != entry.UUID {
+		t.Errorf("expected the new entry in the group Projects, got %d entries", len(serverProjects.Entries))
+	}
+}
+
+func TestMergeTwiceKeepsEntryCount(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	// an entry which only exists on the client
+	clientEntry := gokeepasslib.NewEntry()
+	clientEntry.Values = []gokeepasslib.ValueData{mkValue("Title", "bank"), mkProtectedValue("Password", "secret")}
+	clientEntry.Times.UsageCount = 3
+	clientDb.Content.Root.Groups[0].Entries = append(clientDb.Content.Root.Groups[0].Entries, clientEntry)
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	entries := serverDb.Content.Root.Groups[0].Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries after two comparisons, got %d", len(entries))
+	}
+
+	serverEntry := entries[1]
+	if serverEntry.UUID != clientEntry.UUID {
+		t.Error("expected the server entry to keep the UUID of the client entry")
+	}
+	if !equalTime(serverEntry.Times.CreationTime, clientEntry.Times.CreationTime) || serverEntry.Times.UsageCount != 3 {
+		t.Errorf("expected the server entry to keep the times of the client entry, got %+v", serverEntry.Times)
+	}
+}
+
+func TestMergeReportsChanges(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	// an entry which only exists on the server
+	serverEntry := gokeepasslib.NewEntry()
+	serverEntry.Values = []gokeepasslib.ValueData{mkValue("Title", "bank")}
+	serverDb.Content.Root.Groups[0].Entries = append(serverDb.Content.Root.Groups[0].Entries, serverEntry)
+
+	result := mergeDatabases(t, clientDb, serverDb, Options{})
+
+	expected := []Change{
+		{Type: Updated, Title: "mail", GroupPath: "Root", Winner: Local, Fields: []string{"UserName", "Password", "PIN"}},
+		{Type: Added, Title: "bank", GroupPath: "Root", Winner: Remote},
+	}
+	if len(result.Changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), result.Changes)
+	}
+	for i, change := range result.Changes {
+		change.UUID = ""
+		if !reflect.DeepEqual(change, expected[i]) {
+			t.Errorf("expected the change %+v, got %+v", expected[i], change)
+		}
+	}
+	if result.Changes[1].UUID != hex.EncodeToString(serverEntry.UUID[:]) {
+		t.Errorf("expected the UUID of the server entry, got %s", result.Changes[1].UUID)
+	}
+}
+
+// an entry which only exists on the server doesn't change the server file, so the dbs count as unchanged
+// the client has the same entries as the server except a new server entry, so the client needs the server file
+func TestMergeReportsServerOnlyEntriesOfUnchangedClients(t *testing.T) {
+	clientDb := openTestDatabase(t, "server.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	serverEntry := gokeepasslib.NewEntry()
+	serverEntry.Values = []gokeepasslib.ValueData{mkValue("Title", "bank")}
+	serverDb.Content.Root.Groups[0].Entries = append(serverDb.Content.Root.Groups[0].Entries, serverEntry)
+
+	result := mergeDatabases(t, clientDb, serverDb, Options{})
+	expected := []Change{{Type: Added, UUID: hex.EncodeToString(serverEntry.UUID[:]), Title: "bank", GroupPath: "Root", Winner: Remote}}
+	if !result.Changed || !reflect.DeepEqual(result.Changes, expected) {
+		t.Errorf("expected the server entry to be reported as added, got %+v", result)
+	}
+}
+
+func TestMergeRejectsUnknownConflictPolicy(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	if _, err := Merge(clientDb, serverDb, Options{ConflictPolicy: "oldest-wins"}); err == nil {
+		t.Error("expected an error for an unknown conflict policy")
+	}
+	if _, err := Merge(clientDb, nil, Options{}); err == nil {
+		t.Error("expected an error without a remote db")
+	}
+}
+
+func TestCompareLeavesDatabasesUntouched(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	// the client deleted its entry and added a new one
+	clientRoot := &clientDb.Content.Root.Groups[0]
+	removed := clientRoot.Entries[0]
+	clientEntry := gokeepasslib.NewEntry()
+	clientEntry.Values = []gokeepasslib.ValueData{mkValue("Title", "bank")}
+	clientRoot.Entries = []gokeepasslib.Entry{clientEntry}
+
+	changes, err := Compare(serverDb, clientDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Type != Added || changes[0].Title != "bank" ||
+		changes[1].Type != Deleted || changes[1].UUID != hex.EncodeToString(removed.UUID[:]) {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+	if len(serverDb.Content.Root.Groups[0].Entries) != 1 || serverDb.Content.Root.Groups[0].Entries[0].GetPassword() != "old-password" {
+		t.Error("expected the server db to stay untouched")
+	}
+}
+
+func TestCompareReportsGroups(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+
+	// both dbs have the group Work, the client renamed it and moved the entry into it
+	group := gokeepasslib.NewGroup()
+	group.Name = "Work"
+	serverDb.Content.Root.Groups[0].Groups = append(serverDb.Content.Root.Groups[0].Groups, group)
+	group.Name = "Office"
+	clientRoot := &clientDb.Content.Root.Groups[0]
+	group.Entries = clientRoot.Entries
+	clientRoot.Entries = nil
+	clientRoot.Groups = append(clientRoot.Groups, group)
+
+	changes, err := Compare(serverDb, clientDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Change{
+		{Type: Updated, Group: true, Title: "Office", GroupPath: "Root", Fields: []string{"Name"}},
+		{Type: Updated, Title: "mail", GroupPath: "Root/Office", Fields: []string{"UserName", "Password", "PIN"}},
+		{Type: Moved, Title: "mail", GroupPath: "Root/Office"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), changes)
+	}
+	for i, change := range changes {
+		change.UUID = ""
+		if !reflect.DeepEqual(change, expected[i]) {
+			t.Errorf("expected the change %+v, got %+v", expected[i], change)
+		}
+	}
+}
+
+// the time of the last change of the test entries
+var testModificationTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// creates an unlocked db with the entries in its root group
+func newTestDatabase(entries ...gokeepasslib.Entry) *gokeepasslib.Database {
+	db := gokeepasslib.NewDatabase()
+	db.Content.Root.Groups[0].Entries = entries
+	return db
+}
+
+// creates an entry with a title and a password, which was last changed at the given time
+func newTestEntry(title string, modified time.Time) gokeepasslib.Entry {
+	entry := gokeepasslib.NewEntry()
+	entry.Values = append(entry.Values,
+		gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: title}},
+		gokeepasslib.ValueData{Key: "Password", Value: gokeepasslib.V{Content: "secret", Protected: w.NewBoolWrapper(true)}},
+	)
+	modificationTime := w.TimeWrapper{Time: modified}
+	entry.Times.LastModificationTime = &modificationTime
+	return entry
+}
+
+// adds a tombstone for the UUID to the db, the entry or group itself has to be missing in the db
+func addTombstone(db *gokeepasslib.Database, uuid gokeepasslib.UUID, deletedAt time.Time) {
+	deletionTime := w.TimeWrapper{Time: deletedAt}
+	db.Content.Root.DeletedObjects = append(db.Content.Root.DeletedObjects, gokeepasslib.DeletedObjectData{
+		UUID:         uuid,
+		DeletionTime: &deletionTime,
+	})
+}
+
+// checks if the db has a tombstone for the UUID
+func hasTombstone(db *gokeepasslib.Database, uuid gokeepasslib.UUID) bool {
+	for _, deletedObject := range db.Content.Root.DeletedObjects {
+		if deletedObject.UUID == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMergeRemovesEntriesDeletedOnTheClient(t *testing.T) {
+	entry := newTestEntry("mail", testModificationTime)
+	clientDb := newTestDatabase()
+	serverDb := newTestDatabase(entry)
+	addTombstone(clientDb, entry.UUID, testModificationTime.Add(time.Hour))
+
+	result := mergeDatabases(t, clientDb, serverDb, Options{})
+	if !result.Changed {
+		t.Fatal("expected the server file to be modified")
+	}
+	if entries := serverDb.Content.Root.Groups[0].Entries; len(entries) != 0 {
+		t.Fatalf("expected the entry to be removed from the server, got %d entries", len(entries))
+	}
+	if !hasTombstone(serverDb, entry.UUID) {
+		t.Error("expected the tombstone of the client in the server db")
+	}
+	expected := []Change{{Type: Deleted, UUID: hex.EncodeToString(entry.UUID[:]), Title: "mail", GroupPath: "NewDatabase", Winner: Local}}
+	if !reflect.DeepEqual(result.Changes, expected) {
+		t.Errorf("expected the deletion of the client, got %+v", result.Changes)
+	}
+}
+
+func TestMergeRemovesEntriesDeletedOnTheServer(t *testing.T) {
+	entry := newTestEntry("mail", testModificationTime)
+	clientDb := newTestDatabase(entry)
+	serverDb := newTestDatabase()
+	addTombstone(serverDb, entry.UUID, testModificationTime.Add(time.Hour))
+
+	// the client still has the entry, so it needs the merged file without it
+	result := mergeDatabases(t, clientDb, serverDb, Options{})
+	if !result.Changed {
+		t.Fatal("expected the client to need the server file")
+	}
+	if entries := serverDb.Content.Root.Groups[0].Entries; len(entries) != 0 {
+		t.Fatalf("expected the entry not to be added to the server again, got %d entries", len(entries))
+	}
+	expected := []Change{{Type: Deleted, UUID: hex.EncodeToString(entry.UUID[:]), Title: "mail", GroupPath: "NewDatabase", Winner: Remote}}
+	if !reflect.DeepEqual(result.Changes, expected) {
+		t.Errorf("expected the deletion of the server, got %+v", result.Changes)
+	}
+}
+
+// an entry which was changed on another device after the deletion is kept
+func TestMergeKeepsEntriesChangedAfterTheDeletion(t *testing.T) {
+	entry := newTestEntry("mail", testModificationTime)
+	clientDb := newTestDatabase()
+	serverDb := newTestDatabase(entry)
+	addTombstone(clientDb, entry.UUID, testModificationTime.Add(-time.Hour))
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	if entries := serverDb.Content.Root.Groups[0].Entries; len(entries) != 1 {
+		t.Errorf("expected the changed entry to be kept, got %d entries", len(entries))
+	}
+	if !hasTombstone(serverDb, entry.UUID) {
+		t.Error("expected the tombstone to be kept, so the other devices know about the deletion")
+	}
+}
+
+// adds a compressed binary with the content to the kdbx 3.1 db
+// unlike Database.AddBinary it also adds a second binary with the same content
+func addBinary(db *gokeepasslib.Database, content []byte) *gokeepasslib.Binary {
+	binary := gokeepasslib.Binary{ID: len(db.Content.Meta.Binaries), Compressed: w.NewBoolWrapper(true)}
+	// writing to a buffer doesn't fail
+	_ = binary.SetContent(content)
+	db.Content.Meta.Binaries = append(db.Content.Meta.Binaries, binary)
+	return &db.Content.Meta.Binaries[len(db.Content.Meta.Binaries)-1]
+}
+
+// returns the decoded contents of the attachments of the entry, the keys are the names of the attachments
+func attachmentContents(t *testing.T, entry gokeepasslib.Entry, db *gokeepasslib.Database) map[string]string {
+	contents := make(map[string]string)
+	for _, reference := range entry.Binaries {
+		binary := findBinary(db, reference.Value.ID)
+		if binary == nil {
+			t.Fatalf("the binary of the attachment %s is missing", reference.Name)
+		}
+		content, err := binaryContent(db, *binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[reference.Name] = string(content)
+	}
+	return contents
+}
+
+func TestMergeCopiesAttachmentsOnce(t *testing.T) {
+	serverEntry := newTestEntry("mail", testModificationTime)
+	serverDb := newTestDatabase(serverEntry)
+
+	// two attachments with the same content are stored in two binaries of the client
+	clientDb := newTestDatabase()
+	clientEntry := newTestEntry("mail", testModificationTime.Add(time.Hour))
+	clientEntry.UUID = serverEntry.UUID
+	first := addBinary(clientDb, []byte("recovery codes"))
+	second := addBinary(clientDb, []byte("recovery codes"))
+	clientEntry.Binaries = []gokeepasslib.BinaryReference{first.CreateReference("codes.txt"), second.CreateReference("copy.txt")}
+	// a new entry with the same attachment uses the same binary on the server
+	newEntry := newTestEntry("bank", testModificationTime)
+	newEntry.Binaries = []gokeepasslib.BinaryReference{first.CreateReference("codes.txt")}
+	clientDb.Content.Root.Groups[0].Entries = []gokeepasslib.Entry{clientEntry, newEntry}
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	if len(serverDb.Content.Meta.Binaries) != 1 {
+		t.Fatalf("expected one binary on the server, got %d", len(serverDb.Content.Meta.Binaries))
+	}
+	entries := serverDb.Content.Root.Groups[0].Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected the updated and the new entry, got %d entries", len(entries))
+	}
+	expected := []map[string]string{
+		{"codes.txt": "recovery codes", "copy.txt": "recovery codes"},
+		{"codes.txt": "recovery codes"},
+	}
+	for i, entry := range entries {
+		contents := attachmentContents(t, entry, serverDb)
+		if !reflect.DeepEqual(contents, expected[i]) {
+			t.Errorf("%s: expected the attachments %v, got %v", entry.GetTitle(), expected[i], contents)
+		}
+	}
+}
+
+// returns the entry of the db with the title and fails the test if there is none
+func findEntryByTitle(t *testing.T, db *gokeepasslib.Database, title string) gokeepasslib.Entry {
+	for _, entry := range getMapForAllEntries(db) {
+		if entry.GetTitle() == title {
+			return entry
+		}
+	}
+	t.Fatalf("the entry %s is missing", title)
+	return gokeepasslib.Entry{}
+}
+
+// the kdbx 4 fixture stores its two identical attachments in two binaries of the inner header
+func TestMergeCopiesKdbx4Attachments(t *testing.T) {
+	expected := map[string]string{"codes.txt": "recovery codes", "copy.txt": "recovery codes"}
+
+	// a kdbx 3.1 server file stores the binaries in its metadata
+	serverDb := openTestDatabase(t, "server.kdbx")
+	mergeDatabases(t, openTestDatabase(t, "kdbx4.kdbx"), serverDb, Options{})
+	entry := findEntryByTitle(t, serverDb, "backup codes")
+	if len(serverDb.Content.Meta.Binaries) != 1 {
+		t.Errorf("expected one binary in the metadata, got %d", len(serverDb.Content.Meta.Binaries))
+	}
+	if contents := attachmentContents(t, entry, serverDb); !reflect.DeepEqual(contents, expected) {
+		t.Errorf("expected the attachments %v, got %v", expected, contents)
+	}
+
+	// a kdbx 4 server file stores them in its inner header
+	serverDb = openTestDatabase(t, "kdbx4.kdbx")
+	serverDb.Content.Root.Groups[0].Entries = nil
+	serverDb.Content.InnerHeader.Binaries = nil
+	mergeDatabases(t, openTestDatabase(t, "kdbx4.kdbx"), serverDb, Options{})
+	entry = findEntryByTitle(t, serverDb, "backup codes")
+	if len(serverDb.Content.InnerHeader.Binaries) != 1 || len(serverDb.Content.Meta.Binaries) != 0 {
+		t.Errorf("expected one binary in the inner header, got %d and %d in the metadata",
+			len(serverDb.Content.InnerHeader.Binaries), len(serverDb.Content.Meta.Binaries))
+	}
+	if contents := attachmentContents(t, entry, serverDb); !reflect.DeepEqual(contents, expected) {
+		t.Errorf("expected the attachments %v, got %v", expected, contents)
+	}
+}
+
+// an attachment which is missing in the client file is skipped and returned as an error of the merge
+func TestMergeCollectsMissingAttachments(t *testing.T) {
+	serverDb := newTestDatabase()
+	clientDb := newTestDatabase()
+	entry := newTestEntry("mail", testModificationTime)
+	codes := addBinary(clientDb, []byte("recovery codes"))
+	missing := gokeepasslib.Binary{ID: codes.ID + 1}
+	entry.Binaries = []gokeepasslib.BinaryReference{codes.CreateReference("codes.txt"), missing.CreateReference("missing.txt")}
+	clientDb.Content.Root.Groups[0].Entries = []gokeepasslib.Entry{entry}
+
+	result := mergeDatabases(t, clientDb, serverDb, Options{})
+
+	if len(result.Errors) != 1 {
+		t.Fatalf("expected one error for the missing attachment, got %v", result.Errors)
+	}
+	entries := serverDb.Content.Root.Groups[0].Entries
+	if len(entries) != 1 {
+		t.Fatalf("expected the entry to be added anyway, got %d entries", len(entries))
+	}
+	if contents := attachmentContents(t, entries[0], serverDb); !reflect.DeepEqual(contents, map[string]string{"codes.txt": "recovery codes"}) {
+		t.Errorf("expected only the existing attachment, got %v", contents)
+	}
+}
+
+func TestMergeCopiesCustomFields(t *testing.T) {
+	serverEntry := newTestEntry("mail", testModificationTime)
+	serverEntry.Values = append(serverEntry.Values, gokeepasslib.ValueData{Key: "Security answer", Value: gokeepasslib.V{Content: "blue"}})
+	serverDb := newTestDatabase(serverEntry)
+
+	// the client added a PIN and removed the security answer
+	clientEntry := newTestEntry("mail", testModificationTime.Add(time.Hour))
+	clientEntry.UUID = serverEntry.UUID
+	clientEntry.Values = append(clientEntry.Values, gokeepasslib.ValueData{Key: "PIN", Value: gokeepasslib.V{Content: "1234", Protected: w.NewBoolWrapper(true)}})
+	newEntry := newTestEntry("bank", testModificationTime)
+	newEntry.Values = append(newEntry.Values, gokeepasslib.ValueData{Key: "TOTP Seed", Value: gokeepasslib.V{Content: "JBSWY3DPEHPK3PXP", Protected: w.NewBoolWrapper(true)}})
+	clientDb := newTestDatabase(clientEntry, newEntry)
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	entries := serverDb.Content.Root.Groups[0].Entries
+	if len(entries) != 2 {
+		t.Fatalf("expected the updated and the new entry, got %d entries", len(entries))
+	}
+	if entries[0].Get("Security answer") != nil {
+		t.Error("expected the field which the client removed to be removed on the server")
+	}
+	for i, field := range []string{"PIN", "TOTP Seed"} {
+		value := entries[i].Get(field)
+		if value == nil || !value.Value.Protected.Bool {
+			t.Errorf("%s: expected the protected field %s of the client, got %v", entries[i].GetTitle(), field, value)
+		}
+	}
+	if pin := entries[0].GetContent("PIN"); pin != "1234" {
+		t.Errorf("expected the PIN of the client, got %q", pin)
+	}
+}
+
+// every metadata field is taken from the db which changed it last, so changes of different fields on both devices are kept
+func TestMergeMergesMetadataByChangeTime(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	older := w.TimeWrapper{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	newer := w.TimeWrapper{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	clientMeta := clientDb.Content.Meta
+	serverMeta := serverDb.Content.Meta
+	clientMeta.DatabaseName, clientMeta.DatabaseNameChanged = "client name", &newer
+	serverMeta.DatabaseName, serverMeta.DatabaseNameChanged = "server name", &older
+	clientMeta.DefaultUserName, clientMeta.DefaultUserNameChanged = "client user", &older
+	serverMeta.DefaultUserName, serverMeta.DefaultUserNameChanged = "server user", &newer
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{}).Changed {
+		t.Error("expected the metadata changes to modify the file")
+	}
+	if serverMeta.DatabaseName != "client name" || !serverMeta.DatabaseNameChanged.Time.Equal(newer.Time) {
+		t.Errorf("expected the newer name of the client, got %q", serverMeta.DatabaseName)
+	}
+	if serverMeta.DefaultUserName != "server user" {
+		t.Errorf("expected the newer default user name of the server, got %q", serverMeta.DefaultUserName)
+	}
+	// the server db doesn't share the time with the client db
+	if serverMeta.DatabaseNameChanged == clientMeta.DatabaseNameChanged {
+		t.Error("expected a copy of the change time of the client")
+	}
+}
+
+func TestMergeMergesCustomIconsAndCustomData(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	older := w.TimeWrapper{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	newer := w.TimeWrapper{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	clientMeta := clientDb.Content.Meta
+	serverMeta := serverDb.Content.Meta
+	clientIcon := gokeepasslib.CustomIcon{UUID: gokeepasslib.NewUUID(), Data: "Y2xpZW50"}
+	serverIcon := gokeepasslib.CustomIcon{UUID: gokeepasslib.NewUUID(), Data: "c2VydmVy"}
+	clientMeta.CustomIcons = []gokeepasslib.CustomIcon{clientIcon}
+	serverMeta.CustomIcons = []gokeepasslib.CustomIcon{serverIcon}
+	// the client changed its settings last, so its value of the plugin item wins
+	clientMeta.SettingsChanged, serverMeta.SettingsChanged = &newer, &older
+	clientMeta.CustomData = []gokeepasslib.CustomData{{Key: "plugin", Value: "client"}}
+	serverMeta.CustomData = []gokeepasslib.CustomData{{Key: "plugin", Value: "server"}, {Key: "other", Value: "server"}}
+
+	// the root group of the client uses the new icon
+	clientRoot := &clientDb.Content.Root.Groups[0]
+	clientRoot.CustomIconUUID = clientIcon.UUID
+	clientRoot.Times.LastModificationTime = &w.TimeWrapper{Time: time.Now()}
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{}).Changed {
+		t.Error("expected the metadata changes to modify the file")
+	}
+	expectedIcons := []gokeepasslib.CustomIcon{serverIcon, clientIcon}
+	if !reflect.DeepEqual(serverMeta.CustomIcons, expectedIcons) {
+		t.Errorf("expected the icons of both dbs, got %v", serverMeta.CustomIcons)
+	}
+	expectedData := []gokeepasslib.CustomData{{Key: "plugin", Value: "client"}, {Key: "other", Value: "server"}}
+	if !reflect.DeepEqual(serverMeta.CustomData, expectedData) {
+		t.Errorf("expected the custom data items %v, got %v", expectedData, serverMeta.CustomData)
+	}
+	if serverRoot := serverDb.Content.Root.Groups[0]; serverRoot.CustomIconUUID != clientIcon.UUID {
+		t.Error("expected the custom icon of the newer client group")
+	}
+}
+
+// sets the tags, icons, colours, expiry, AutoType settings and custom data which are checked by the property tests on the entry
+func setEntryProperties(entry *gokeepasslib.Entry, expiryTime time.Time) {
+	expires := w.TimeWrapper{Time: expiryTime}
+	entry.CustomIconUUID = gokeepasslib.NewUUID()
+	entry.CustomData = []gokeepasslib.CustomData{{Key: "KPXC_DECRYPTION_KEYS", Value: "plugin data"}}
+	entry.Tags = "work;mail"
+	entry.ForegroundColor = "#FF0000"
+	entry.BackgroundColor = "#00FF00"
+	entry.Times.Expires = w.NewBoolWrapper(true)
+	entry.Times.ExpiryTime = &expires
+	entry.AutoType.Associations = []gokeepasslib.AutoTypeAssociation{{Window: "Mail*", KeystrokeSequence: "{USERNAME}{ENTER}"}}
+}
+
+func TestMergeCarriesEntryProperties(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	clientEntry := &clientDb.Content.Root.Groups[0].Entries[0]
+	setEntryProperties(clientEntry, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	serverEntry := serverDb.Content.Root.Groups[0].Entries[0]
+	if !equalEntryProperties(serverEntry, *clientEntry) {
+		t.Fatalf("expected the properties of the newer client entry, got %+v", serverEntry)
+	}
+	// the server db doesn't share the pointers of the client db
+	if serverEntry.Times.ExpiryTime == clientEntry.Times.ExpiryTime || &serverEntry.AutoType.Associations[0] == &clientEntry.AutoType.Associations[0] ||
+		&serverEntry.CustomData[0] == &clientEntry.CustomData[0] {
+		t.Error("expected copies of the expiry time, the AutoType associations and the custom data of the client")
+	}
+}
+
+// the client only changed the properties and the server only changed a field, so both changes are kept
+func TestMergeMergesEntryPropertiesWithSyncBase(t *testing.T) {
+	clientDb := openTestDatabase(t, "server.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	baseDb := openTestDatabase(t, "server.kdbx")
+
+	clientEntry := &clientDb.Content.Root.Groups[0].Entries[0]
+	setEntryProperties(clientEntry, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	clientModificationTime := w.TimeWrapper{Time: clientEntry.Times.LastModificationTime.Time.Add(time.Hour)}
+	clientEntry.Times.LastModificationTime = &clientModificationTime
+
+	serverEntry := &serverDb.Content.Root.Groups[0].Entries[0]
+	serverEntry.Get("URL").Value.Content = "https://new-mail.example.com"
+	serverModificationTime := w.TimeWrapper{Time: clientModificationTime.Time.Add(time.Hour)}
+	serverEntry.Times.LastModificationTime = &serverModificationTime
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{Base: baseDb}).Changed {
+		t.Fatal("expected the server file to be modified")
+	}
+	if !equalEntryProperties(*serverEntry, *clientEntry) {
+		t.Errorf("expected the properties of the client, got %+v", serverEntry)
+	}
+	if url := serverEntry.GetContent("URL"); url != "https://new-mail.example.com" {
+		t.Errorf("expected the URL of the server, got %q", url)
+	}
+}
+
+// adds an empty recycle bin group to the root group of the db and returns it
+func addRecycleBin(db *gokeepasslib.Database) *gokeepasslib.Group {
+	group := gokeepasslib.NewGroup()
+	group.Name = "Recycle Bin"
+	root := &db.Content.Root.Groups[0]
+	root.Groups = append(root.Groups, group)
+	db.Content.Meta.RecycleBinEnabled = w.NewBoolWrapper(true)
+	db.Content.Meta.RecycleBinUUID = group.UUID
+	return &root.Groups[len(root.Groups)-1]
+}
+
+// moves the first entry of the root group into the group at the given time
+func recycleEntry(db *gokeepasslib.Database, recycleBin *gokeepasslib.Group, recycledAt time.Time) gokeepasslib.Entry {
+	entry := removeEntry(&db.Content.Root.Groups[0], db.Content.Root.Groups[0].Entries[0].UUID)
+	locationChanged := w.TimeWrapper{Time: recycledAt}
+	entry.Times.LocationChanged = &locationChanged
+	recycleBin.Entries = append(recycleBin.Entries, entry)
+	return entry
+}
+
+// both devices created their own recycle bin, the entry which the client recycled ends up in the recycle bin of the server
+func TestMergeMapsTheRecycleBinOfTheClient(t *testing.T) {
+	clientDb := openTestDatabase(t, "client.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	serverRecycleBin := addRecycleBin(serverDb).UUID
+	entry := recycleEntry(clientDb, addRecycleBin(clientDb), time.Now())
+
+	mergeDatabases(t, clientDb, serverDb, Options{})
+
+	root := serverDb.Content.Root.Groups[0]
+	if len(root.Groups) != 1 || root.Groups[0].UUID != serverRecycleBin {
+		t.Fatalf("expected only the recycle bin of the server, got %d groups", len(root.Groups))
+	}
+	if len(root.Entries) != 0 || len(root.Groups[0].Entries) != 1 || root.Groups[0].Entries[0].UUID != entry.UUID {
+		t.Errorf("expected the entry in the recycle bin of the server, got %d entries in the root group", len(root.Entries))
+	}
+	if serverDb.Content.Meta.RecycleBinUUID != serverRecycleBin {
+		t.Error("expected the server to keep its recycle bin")
+	}
+}
+
+func TestMergeEmptiesTheRecycleBin(t *testing.T) {
+	clientDb := openTestDatabase(t, "server.kdbx")
+	serverDb := openTestDatabase(t, "server.kdbx")
+	recycleBin := addRecycleBin(serverDb)
+	oldEntry := recycleEntry(serverDb, recycleBin, time.Now().Add(-60*24*time.Hour))
+	clientDb.Content.Root.Groups[0].Entries = nil
+
+	newEntry := gokeepasslib.NewEntry()
+	newEntry.Values = append(newEntry.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: "recent"}})
+	recycleBin.Entries = append(recycleBin.Entries, newEntry)
+
+	if !mergeDatabases(t, clientDb, serverDb, Options{EmptyRecycleBinAfter: 30 * 24 * time.Hour}).Changed {
+		t.Error("expected the emptied recycle bin to modify the file")
+	}
+
+	recycleBin = findGroup(serverDb.Content.Root.Groups, serverDb.Content.Meta.RecycleBinUUID)
+	if len(recycleBin.Entries) != 1 || recycleBin.Entries[0].UUID != newEntry.UUID {
+		t.Fatalf("expected only the recently recycled entry, got %d entries", len(recycleBin.Entries))
+	}
+	if !hasTombstone(serverDb, oldEntry.UUID) {
+		t.Error("expected a tombstone for the removed entry, so it is deleted on the clients as well")
+	}
+}
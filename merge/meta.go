@@ -0,0 +1,123 @@
+package merge
+
+import (
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// compares the metadata of both dbs, for every field the value with the newer change time is used
+// the custom icons and the custom data items of both dbs are merged
+func (c *comparison) compareMetadata(){
+	clientMeta := c.clientDb.Content.Meta
+	serverMeta := c.serverDb.Content.Meta
+
+	c.compareMetaString(&serverMeta.DatabaseName, clientMeta.DatabaseName,
+		&serverMeta.DatabaseNameChanged, clientMeta.DatabaseNameChanged)
+	c.compareMetaString(&serverMeta.DatabaseDescription, clientMeta.DatabaseDescription,
+		&serverMeta.DatabaseDescriptionChanged, clientMeta.DatabaseDescriptionChanged)
+	c.compareMetaString(&serverMeta.DefaultUserName, clientMeta.DefaultUserName,
+		&serverMeta.DefaultUserNameChanged, clientMeta.DefaultUserNameChanged)
+	c.compareMetaString(&serverMeta.EntryTemplatesGroup, clientMeta.EntryTemplatesGroup,
+		&serverMeta.EntryTemplatesGroupChanged, clientMeta.EntryTemplatesGroupChanged)
+	c.compareCustomIcons()
+	c.compareMetaCustomData()
+
+	// the recycle bin settings share one change time
+	if serverMeta.RecycleBinEnabled == clientMeta.RecycleBinEnabled && serverMeta.RecycleBinUUID == clientMeta.RecycleBinUUID {
+		return
+	}
+	c.fileModified = true
+
+	// the recycle bin of the client is used if the server doesn't have one yet
+	if isNewer(clientMeta.RecycleBinChanged, serverMeta.RecycleBinChanged) || (!hasRecycleBin(c.serverDb) && hasRecycleBin(c.clientDb)) {
+		serverMeta.RecycleBinEnabled = clientMeta.RecycleBinEnabled
+		serverMeta.RecycleBinUUID = clientMeta.RecycleBinUUID
+		serverMeta.RecycleBinChanged = copyTime(clientMeta.RecycleBinChanged)
+	}
+}
+
+// sets the client value of a metadata field on the server if the client changed it after the server
+func (c *comparison) compareMetaString(serverValue *string, clientValue string, serverChanged **w.TimeWrapper, clientChanged *w.TimeWrapper){
+	if *serverValue == clientValue {
+		return
+	}
+	// either the server value is changed or the client needs the newer server value
+	c.fileModified = true
+
+	if isNewer(clientChanged, *serverChanged) {
+		*serverValue = clientValue
+		*serverChanged = copyTime(clientChanged)
+	}
+}
+
+// adds the custom icons of the client which the server doesn't have, so the synced entries and groups
+// find the icons which they reference on every device
+// an icon isn't changed under its UUID, so the server keeps its own icon if both dbs have the UUID
+func (c *comparison) compareCustomIcons(){
+	clientIcons := c.clientDb.Content.Meta.CustomIcons
+	serverMeta := c.serverDb.Content.Meta
+
+	for _, clientIcon := range clientIcons{
+		serverIcon := findCustomIcon(serverMeta.CustomIcons, clientIcon.UUID)
+		if serverIcon == nil{
+			serverMeta.CustomIcons = append(serverMeta.CustomIcons, clientIcon)
+			c.fileModified = true
+		} else if serverIcon.Data != clientIcon.Data{
+			c.fileModified = true
+		}
+	}
+	// the client needs the icons which only the server has
+	if len(serverMeta.CustomIcons) != len(clientIcons){
+		c.fileModified = true
+	}
+}
+
+// returns the custom icon with the UUID or nil if there is none
+func findCustomIcon(icons []gokeepasslib.CustomIcon, uuid gokeepasslib.UUID) *gokeepasslib.CustomIcon{
+	for i := range icons{
+		if icons[i].UUID == uuid{
+			return &icons[i]
+		}
+	}
+	return nil
+}
+
+// merges the custom data items of plugins in the metadata by their key
+// the items have no change time, so for a key with different values the value of the db whose settings were changed last is used
+func (c *comparison) compareMetaCustomData(){
+	clientMeta := c.clientDb.Content.Meta
+	serverMeta := c.serverDb.Content.Meta
+	c.mergeCustomData(&serverMeta.CustomData, clientMeta.CustomData, isNewer(clientMeta.SettingsChanged, serverMeta.SettingsChanged))
+}
+
+// adds the custom data items of the client which the server doesn't have,
+// the value of an item which both have is only taken from the client if the client is newer
+func (c *comparison) mergeCustomData(serverItems *[]gokeepasslib.CustomData, clientItems []gokeepasslib.CustomData, clientIsNewer bool){
+	for _, clientItem := range clientItems{
+		serverItem := findCustomData(*serverItems, clientItem.Key)
+		if serverItem == nil{
+			*serverItems = append(*serverItems, clientItem)
+			c.fileModified = true
+		} else if serverItem.Value != clientItem.Value{
+			// either the server item is changed or the client needs the newer server item
+			c.fileModified = true
+			if clientIsNewer{
+				serverItem.Value = clientItem.Value
+			}
+		}
+	}
+	// the client needs the items which only the server has
+	if len(*serverItems) != len(clientItems){
+		c.fileModified = true
+	}
+}
+
+// returns the custom data item with the key or nil if there is none
+func findCustomData(items []gokeepasslib.CustomData, key string) *gokeepasslib.CustomData{
+	for i := range items{
+		if items[i].Key == key{
+			return &items[i]
+		}
+	}
+	return nil
+}
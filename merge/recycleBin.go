@@ -0,0 +1,94 @@
+package merge
+
+import (
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+	"time"
+)
+
+// every device creates its own recycle bin group, if the client and the server have different recycle bins
+// the client recycle bin is mapped on the recycle bin of the server, otherwise the server would get a second recycle bin
+// only the client db in the memory is changed, the client gets the server recycle bin with the next file
+func mapRecycleBin(clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database){
+	clientRecycleBin := clientDb.Content.Meta.RecycleBinUUID
+	serverRecycleBin := serverDb.Content.Meta.RecycleBinUUID
+	if clientRecycleBin == serverRecycleBin || findGroup(serverDb.Content.Root.Groups, serverRecycleBin) == nil {
+		return
+	}
+
+	if group := findGroup(clientDb.Content.Root.Groups, clientRecycleBin); group != nil {
+		group.UUID = serverRecycleBin
+	}
+	clientDb.Content.Meta.RecycleBinUUID = serverRecycleBin
+}
+
+// checks if the recycle bin of the db exists
+func hasRecycleBin(db *gokeepasslib.Database) bool{
+	var empty gokeepasslib.UUID
+	return db.Content.Meta.RecycleBinUUID != empty && findGroup(db.Content.Root.Groups, db.Content.Meta.RecycleBinUUID) != nil
+}
+
+// removes the entries and groups which were moved into the recycle bin of the server before the given age
+// the removed objects are added to the deleted objects, so they are deleted on the clients as well
+func (c *comparison) emptyRecycleBin(maxAge time.Duration){
+	if !hasRecycleBin(c.serverDb) {
+		return
+	}
+	recycleBin := findGroup(c.serverDb.Content.Root.Groups, c.serverDb.Content.Meta.RecycleBinUUID)
+	deleteBefore := time.Now().Add(-maxAge)
+
+	keptEntries := recycleBin.Entries[:0]
+	for _, entry := range recycleBin.Entries{
+		if recycledAt(entry.Times).Before(deleteBefore) {
+			c.report(Deleted, entry, Remote, nil)
+			c.addDeletedObject(entry.UUID)
+			continue
+		}
+		keptEntries = append(keptEntries, entry)
+	}
+	recycleBin.Entries = keptEntries
+
+	keptGroups := recycleBin.Groups[:0]
+	for _, group := range recycleBin.Groups{
+		if recycledAt(group.Times).Before(deleteBefore) {
+			c.addDeletedGroup(group)
+			continue
+		}
+		keptGroups = append(keptGroups, group)
+	}
+	recycleBin.Groups = keptGroups
+}
+
+// the location change time is the time when an object was moved into the recycle bin
+func recycledAt(times gokeepasslib.TimeData) time.Time{
+	if times.LocationChanged != nil {
+		return times.LocationChanged.Time
+	}
+	if times.LastModificationTime != nil {
+		return times.LastModificationTime.Time
+	}
+	return time.Time{}
+}
+
+// adds the group and all its entries and sub-groups to the deleted objects
+func (c *comparison) addDeletedGroup(group gokeepasslib.Group){
+	for _, entry := range group.Entries{
+		c.report(Deleted, entry, Remote, nil)
+		c.addDeletedObject(entry.UUID)
+	}
+	for _, subGroup := range group.Groups{
+		c.addDeletedGroup(subGroup)
+	}
+	c.addDeletedObject(group.UUID)
+}
+
+// adds a deleted object with the current time to the server db
+func (c *comparison) addDeletedObject(uuid gokeepasslib.UUID){
+	now := w.Now()
+	c.deletedObjects[uuid] = now.Time
+	c.serverDb.Content.Root.DeletedObjects = append(c.serverDb.Content.Root.DeletedObjects, gokeepasslib.DeletedObjectData{
+		UUID:         uuid,
+		DeletionTime: &now,
+	})
+	c.fileModified = true
+}
@@ -0,0 +1,187 @@
+package merge
+
+import (
+	"encoding/hex"
+	"github.com/tobischo/gokeepasslib/v3"
+	"strings"
+)
+
+// types of the changes in the report of a merge
+const (
+	Added    = "added"
+	Updated  = "updated"
+	Deleted  = "deleted"
+	Moved    = "moved"
+	Conflict = "conflict"
+)
+
+// the sides of a merge, the winner of a change is the side whose version is in the merged db
+const (
+	Local  = "local"
+	Remote = "remote"
+	// both sides changed different fields of the entry
+	Both = "both"
+)
+
+// Change describes the change of an entry by a merge, it never contains the values of the fields
+type Change struct {
+	Type string `json:"type"`
+	// Group is true if the change describes a group instead of an entry, the title is the name of the group
+	Group bool `json:"group,omitempty"`
+	// UUID of the entry in hex, like keepass shows it
+	UUID  string `json:"uuid"`
+	Title string `json:"title"`
+	// GroupPath contains the names of the groups of the entry in the merged db separated by "/"
+	GroupPath string `json:"groupPath"`
+	// Winner is empty if the change isn't the result of a merge (see Compare)
+	Winner    string `json:"winner,omitempty"`
+	// Fields contains the names of the fields which are different on both sides
+	Fields []string `json:"fields,omitempty"`
+	// ConflictCopy marks an added entry which contains the losing version of a conflict (see Duplicate)
+	ConflictCopy bool `json:"conflictCopy,omitempty"`
+}
+
+// adds a change of the entry to the report, the report doesn't decide if the dbs were different
+// the group path is taken from the server db or from the client db if the entry isn't on the server
+func (c *comparison) report(changeType string, entry gokeepasslib.Entry, winner string, fields []string){
+	groups := c.serverDb.Content.Root.Groups
+	if groupPath(groups, entry.UUID) == nil {
+		groups = c.clientDb.Content.Root.Groups
+	}
+
+	c.changes = append(c.changes, newChange(changeType, entry, groups, winner, fields))
+}
+
+// creates a change of the entry, the group path is taken from the given groups
+func newChange(changeType string, entry gokeepasslib.Entry, groups []gokeepasslib.Group, winner string, fields []string) Change{
+	return Change{
+		Type:      changeType,
+		UUID:      hex.EncodeToString(entry.UUID[:]),
+		Title:     entry.GetTitle(),
+		GroupPath: strings.Join(groupPath(groups, entry.UUID), "/"),
+		Winner:    winner,
+		Fields:    fields,
+	}
+}
+
+// reports an entry which is removed from the server db because of a deleted object
+// the deletion comes from the client if the client db contains the deleted object
+func (c *comparison) reportDeletion(entry gokeepasslib.Entry){
+	winner := Remote
+	if hasDeletedObject(c.clientDb, entry.UUID) {
+		winner = Local
+	}
+	c.report(Deleted, entry, winner, nil)
+}
+
+// checks if the deleted objects of the db contain the UUID
+func hasDeletedObject(db *gokeepasslib.Database, uuid gokeepasslib.UUID) bool{
+	for _, deletedObject := range db.Content.Root.DeletedObjects{
+		if deletedObject.UUID == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// reports the entries which were only in the server db before the merge, the client gets them with the merged db
+// they are only reported if the dbs were different, otherwise the client doesn't get the merged db
+// the groups are walked in their order, so the report has the same order as the db
+func (c *comparison) reportServerOnlyEntries(groups []gokeepasslib.Group, clientEntries map[gokeepasslib.UUID]gokeepasslib.Entry){
+	for _, group := range groups{
+		for _, entry := range group.Entries{
+			_, existed := c.serverEntries[entry.UUID]
+			if _, ok := clientEntries[entry.UUID]; existed && !ok {
+				c.report(Added, entry, Remote, nil)
+			}
+		}
+		c.reportServerOnlyEntries(group.Groups, clientEntries)
+	}
+}
+
+// returns the names of the fields which are different in both entries
+// attachments and the other properties (e.g. tags, icon and expiry) are reported as one field each
+func (c *comparison) changedFields(serverEntry gokeepasslib.Entry, clientEntry gokeepasslib.Entry) []string{
+	var fields []string
+	for _, value := range serverEntry.Values{
+		if !equalValue(&value, clientEntry.Get(value.Key)) {
+			fields = append(fields, value.Key)
+		}
+	}
+	for _, value := range clientEntry.Values{
+		if serverEntry.Get(value.Key) == nil {
+			fields = append(fields, value.Key)
+		}
+	}
+
+	if attachmentsFingerprint(serverEntry, c.serverDb) != attachmentsFingerprint(clientEntry, c.clientDb) {
+		fields = append(fields, "Attachments")
+	}
+	if !equalEntryProperties(serverEntry, clientEntry) {
+		fields = append(fields, "Properties")
+	}
+	return fields
+}
+
+// creates a change of the group, the group path is the path of the parent group in the given groups
+func newGroupChange(changeType string, group gokeepasslib.Group, groups []gokeepasslib.Group, fields []string) Change{
+	return Change{
+		Type:      changeType,
+		Group:     true,
+		UUID:      hex.EncodeToString(group.UUID[:]),
+		Title:     group.Name,
+		GroupPath: strings.Join(parentGroupPath(groups, group.UUID), "/"),
+		Fields:    fields,
+	}
+}
+
+// returns the names of the properties which are different in both groups, the entries and sub-groups are not compared
+func changedGroupFields(a gokeepasslib.Group, b gokeepasslib.Group) []string{
+	var fields []string
+	if a.Name != b.Name {
+		fields = append(fields, "Name")
+	}
+	if a.Notes != b.Notes {
+		fields = append(fields, "Notes")
+	}
+	if a.IconID != b.IconID || a.CustomIconUUID != b.CustomIconUUID {
+		fields = append(fields, "IconID")
+	}
+	if a.DefaultAutoTypeSequence != b.DefaultAutoTypeSequence || a.EnableAutoType != b.EnableAutoType {
+		fields = append(fields, "AutoType")
+	}
+	if a.EnableSearching != b.EnableSearching {
+		fields = append(fields, "EnableSearching")
+	}
+	return fields
+}
+
+// returns the names of the groups from the root group to the parent group of the group
+func parentGroupPath(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) []string{
+	for _, group := range groups{
+		for _, subGroup := range group.Groups{
+			if subGroup.UUID == uuid {
+				return []string{group.Name}
+			}
+		}
+		if path := parentGroupPath(group.Groups, uuid); path != nil {
+			return append([]string{group.Name}, path...)
+		}
+	}
+	return nil
+}
+
+// returns the names of the groups from the root group to the group which contains the entry
+func groupPath(groups []gokeepasslib.Group, uuid gokeepasslib.UUID) []string{
+	for _, group := range groups{
+		for _, entry := range group.Entries{
+			if entry.UUID == uuid {
+				return []string{group.Name}
+			}
+		}
+		if path := groupPath(group.Groups, uuid); path != nil {
+			return append([]string{group.Name}, path...)
+		}
+	}
+	return nil
+}
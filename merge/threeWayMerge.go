@@ -0,0 +1,271 @@
+package merge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+	"sort"
+	"strings"
+)
+
+// policies for a conflict, a conflict means that the client and the server changed the same field since the last sync
+const (
+	// NewestWins uses the field of the newer entry
+	NewestWins = "newest-wins"
+	// ServerWins uses the field of the server (remote) entry
+	ServerWins = "server-wins"
+	// ClientWins uses the field of the client (local) entry
+	ClientWins = "client-wins"
+	// Duplicate lets the newer entry win, but the other version is kept as a separate entry next to the merged entry
+	Duplicate = "duplicate"
+)
+
+// suffix for the title and tag of an entry which contains the losing version of a conflict
+const conflictTag = "conflict"
+
+// merges the client entry into the server entry with the help of the base entry,
+// the base entry is the version of the entry which the client got with the last sync
+// fields which were only changed on one side are taken from this side, only if both sides changed the same field
+// the conflict policy decides which field wins
+func (c *comparison) mergeWithBase(serverEntry *gokeepasslib.Entry, clientEntry gokeepasslib.Entry, baseEntry gokeepasslib.Entry){
+	clientIsNewer := clientEntry.Times.LastModificationTime.Time.After(serverEntry.Times.LastModificationTime.Time)
+	clientWinsConflicts := c.clientWinsConflicts(clientIsNewer)
+	fields := c.changedFields(*serverEntry, clientEntry)
+
+	values, conflict := mergeValues(serverEntry.Values, clientEntry.Values, baseEntry.Values, clientWinsConflicts)
+
+	// the attachments are merged as a whole, because an attachment can't be merged field by field
+	serverAttachments := attachmentsFingerprint(*serverEntry, c.serverDb)
+	clientAttachments := attachmentsFingerprint(clientEntry, c.clientDb)
+	baseAttachments := attachmentsFingerprint(baseEntry, c.baseDb)
+	attachmentsConflict := serverAttachments != clientAttachments && serverAttachments != baseAttachments && clientAttachments != baseAttachments
+	takeClientAttachments := serverAttachments != clientAttachments &&
+		(serverAttachments == baseAttachments || (attachmentsConflict && clientWinsConflicts))
+
+	// the other properties (e.g. tags, icon and expiry) are merged as a whole as well
+	equalProperties := equalEntryProperties(*serverEntry, clientEntry)
+	propertiesConflict := !equalProperties && !equalEntryProperties(*serverEntry, baseEntry) && !equalEntryProperties(clientEntry, baseEntry)
+	takeClientProperties := !equalProperties &&
+		(equalEntryProperties(*serverEntry, baseEntry) || (propertiesConflict && clientWinsConflicts))
+
+	// the losing version is copied before the server entry is changed
+	var conflictCopy *gokeepasslib.Entry
+	if (conflict || attachmentsConflict || propertiesConflict) && c.conflictPolicy == Duplicate {
+		conflictCopy = c.createConflictCopy(*serverEntry, clientEntry, clientWinsConflicts)
+	}
+
+	serverChanged := !equalValues(values, serverEntry.Values) || takeClientAttachments || takeClientProperties
+	clientChanged := !equalValues(values, clientEntry.Values) || (serverAttachments != clientAttachments && !takeClientAttachments) ||
+		(!equalProperties && !takeClientProperties)
+	if !serverChanged && !clientChanged {
+		c.mergeHistories(serverEntry, nil, clientEntry, nil)
+		return
+	}
+	c.fileModified = true
+
+	var serverVersions, clientVersions []gokeepasslib.Entry
+	if clientChanged {
+		// the client version is kept in the history, because it is replaced on the client
+		clientVersions = append(clientVersions, historySnapshot(clientEntry))
+	}
+	if serverChanged {
+		serverVersions = append(serverVersions, historySnapshot(*serverEntry))
+
+		serverEntry.Values = values
+		if takeClientAttachments {
+			serverEntry.Binaries = c.copyBinaries(clientEntry)
+		}
+		if takeClientProperties {
+			copyEntryProperties(serverEntry, clientEntry)
+		}
+
+		// if the result is a mix of both versions it is a new version of the entry
+		modificationTime := *clientEntry.Times.LastModificationTime
+		if clientChanged {
+			modificationTime = w.Now()
+		}
+		serverEntry.Times.LastModificationTime = &modificationTime
+	}
+	c.mergeHistories(serverEntry, serverVersions, clientEntry, clientVersions)
+	c.reportMerge(*serverEntry, fields, conflict || attachmentsConflict || propertiesConflict, clientWinsConflicts, serverChanged, clientChanged)
+
+	// the copy is added at the end, because adding an entry to the group moves the server entry in the memory
+	if conflictCopy != nil {
+		group := findParentGroup(c.serverDb.Content.Root.Groups, serverEntry.UUID)
+		group.Entries = append(group.Entries, *conflictCopy)
+		c.reportConflictCopy(*conflictCopy, clientWinsConflicts)
+	}
+}
+
+// reports the conflict copy as an added entry which is marked as a conflict
+// the winner is the side whose losing version is kept in the copy
+func (c *comparison) reportConflictCopy(conflictCopy gokeepasslib.Entry, clientWinsConflicts bool){
+	winner := Local
+	if clientWinsConflicts {
+		winner = Remote
+	}
+	change := newChange(Added, conflictCopy, c.serverDb.Content.Root.Groups, winner, nil)
+	change.ConflictCopy = true
+	c.changes = append(c.changes, change)
+}
+
+// reports the result of a merge with the base entry
+// the winner of a conflict is the side whose fields won, without a conflict it is the side whose changes were taken over
+func (c *comparison) reportMerge(entry gokeepasslib.Entry, fields []string, conflict bool, clientWinsConflicts bool, serverChanged bool, clientChanged bool){
+	switch {
+	case conflict && clientWinsConflicts:
+		c.report(Conflict, entry, Local, fields)
+	case conflict:
+		c.report(Conflict, entry, Remote, fields)
+	case serverChanged && clientChanged:
+		c.report(Updated, entry, Both, fields)
+	case serverChanged:
+		c.report(Updated, entry, Local, fields)
+	default:
+		c.report(Updated, entry, Remote, fields)
+	}
+}
+
+// decides with the conflict policy if the client wins a conflict
+// an unknown policy is handled like newest-wins
+func (c *comparison) clientWinsConflicts(clientIsNewer bool) bool{
+	switch c.conflictPolicy {
+	case ServerWins:
+		return false
+	case ClientWins:
+		return true
+	default:
+		return clientIsNewer
+	}
+}
+
+// creates a new entry with the losing version of a conflict, so it can be resolved by hand (e.g. in KeePassXC)
+// the entry gets a conflict suffix in the title, a conflict tag and the device which created the version,
+// for the server version this is the device which changed the server entry last
+func (c *comparison) createConflictCopy(serverEntry gokeepasslib.Entry, clientEntry gokeepasslib.Entry, clientWinsConflicts bool) *gokeepasslib.Entry{
+	entry := gokeepasslib.NewEntry()
+	if clientWinsConflicts {
+		entry.Values = copyValues(serverEntry.Values)
+		entry.Binaries = append([]gokeepasslib.BinaryReference(nil), serverEntry.Binaries...)
+		copyEntryProperties(&entry, serverEntry)
+		device := c.serverDevice
+		if entryDevice, ok := c.serverEntryDevices[serverEntry.UUID]; ok {
+			device = entryDevice
+		}
+		setValue(&entry, mkValue("ConflictDevice", device))
+	} else {
+		entry.Values = copyValues(clientEntry.Values)
+		entry.Binaries = c.copyBinaries(clientEntry)
+		copyEntryProperties(&entry, clientEntry)
+		setValue(&entry, mkValue("ConflictDevice", c.clientDevice))
+	}
+
+	setValue(&entry, mkValue("Title", entry.GetTitle()+" ("+conflictTag+")"))
+	if entry.Tags != ""{
+		entry.Tags += ";"
+	}
+	entry.Tags += conflictTag
+	return &entry
+}
+
+// sets the content of a field or appends the field if the entry doesn't have it
+func setValue(entry *gokeepasslib.Entry, value gokeepasslib.ValueData){
+	if existing := entry.Get(value.Key); existing != nil{
+		existing.Value.Content = value.Value.Content
+		return
+	}
+	entry.Values = append(entry.Values, value)
+}
+
+// merges the string fields of the server and the client with the fields of the base version
+// a field which is unchanged on one side takes the value of the other side,
+// a field which was changed differently on both sides is a conflict, the returned boolean indicates if there was a conflict
+func mergeValues(serverValues []gokeepasslib.ValueData, clientValues []gokeepasslib.ValueData, baseValues []gokeepasslib.ValueData, clientWinsConflicts bool) ([]gokeepasslib.ValueData, bool){
+	// the server keeps the order of its fields and the new client fields are appended
+	var keys []string
+	for _, value := range serverValues{
+		keys = append(keys, value.Key)
+	}
+	for _, value := range clientValues{
+		if findValue(serverValues, value.Key) == nil{
+			keys = append(keys, value.Key)
+		}
+	}
+
+	var merged []gokeepasslib.ValueData
+	conflict := false
+	for _, key := range keys{
+		serverValue := findValue(serverValues, key)
+		clientValue := findValue(clientValues, key)
+		baseValue := findValue(baseValues, key)
+
+		chosen := serverValue
+		switch {
+		case equalValue(clientValue, serverValue), equalValue(clientValue, baseValue):
+			// nothing or only the server changed
+		case equalValue(serverValue, baseValue):
+			chosen = clientValue
+		default:
+			conflict = true
+			if clientWinsConflicts {
+				chosen = clientValue
+			}
+		}
+
+		// a missing field was removed on the chosen side
+		if chosen != nil{
+			merged = append(merged, *chosen)
+		}
+	}
+	return merged, conflict
+}
+
+// returns the field with the given key or nil if there is no such field
+func findValue(values []gokeepasslib.ValueData, key string) *gokeepasslib.ValueData{
+	for i := range values{
+		if values[i].Key == key{
+			return &values[i]
+		}
+	}
+	return nil
+}
+
+// two fields are equal if both are missing or both have the same content
+func equalValue(a *gokeepasslib.ValueData, b *gokeepasslib.ValueData) bool{
+	if a == nil || b == nil{
+		return a == b
+	}
+	return a.Value.Content == b.Value.Content
+}
+
+// checks if both entries have the same fields with the same content, the order of the fields doesn't matter
+func equalValues(a []gokeepasslib.ValueData, b []gokeepasslib.ValueData) bool{
+	if len(a) != len(b){
+		return false
+	}
+	for i := range a{
+		if !equalValue(&a[i], findValue(b, a[i].Key)){
+			return false
+		}
+	}
+	return true
+}
+
+// returns a string which represents the names and contents of all attachments of an entry
+// attachments of different dbs can't be compared by their ID, because the IDs are only valid in their own db
+func attachmentsFingerprint(entry gokeepasslib.Entry, db *gokeepasslib.Database) string{
+	var attachments []string
+	for _, reference := range entry.Binaries{
+		content := "missing"
+		if binary := findBinary(db, reference.Value.ID); binary != nil{
+			if decoded, err := binaryContent(db, *binary); err == nil{
+				hash := sha256.Sum256(decoded)
+				content = hex.EncodeToString(hash[:])
+			}
+		}
+		attachments = append(attachments, reference.Name+":"+content)
+	}
+	sort.Strings(attachments)
+	return strings.Join(attachments, "\n")
+}
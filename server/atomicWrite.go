@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/tobischo/gokeepasslib/v3"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// the signature at the beginning of every kdbx file
+var keepassSignature = []byte{0x03, 0xd9, 0xa2, 0x9a, 0x67, 0xfb, 0x4b, 0xb5}
+
+// WriteFileAtomically replaces the keepass file at the path without the risk of a truncated file
+// the file is written to a temporary file in the same directory, synced to the disk, read again and checked with verify,
+// only then the temporary file is renamed over the old file, so the path contains either the old or the new file
+// verify can be nil, the kdbx signature and the written content are always checked
+func WriteFileAtomically(path string, file []byte, verify func(written []byte) error) error{
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil{
+		return err
+	}
+	// removes the temporary file if it wasn't renamed
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(temp.Name())
+		}
+	}()
+
+	if _, err := temp.Write(file); err != nil{
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil{
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil{
+		return err
+	}
+
+	if err := verifyWrittenFile(temp.Name(), file, verify); err != nil{
+		return err
+	}
+
+	// the new file gets the permissions of the old file
+	if info, err := os.Stat(path); err == nil{
+		if err := os.Chmod(temp.Name(), info.Mode().Perm()); err != nil{
+			return err
+		}
+	}
+
+	if err := os.Rename(temp.Name(), path); err != nil{
+		return err
+	}
+	renamed = true
+
+	syncDirectory(filepath.Dir(path))
+	return nil
+}
+
+// reads the written file again and checks if it is the expected keepass file
+func verifyWrittenFile(path string, expected []byte, verify func(written []byte) error) error{
+	written, err := ioutil.ReadFile(path)
+	if err != nil{
+		return err
+	}
+	if !bytes.Equal(written, expected) {
+		return errors.New("the written file is different from the expected file")
+	}
+	if !bytes.HasPrefix(written, keepassSignature) {
+		return errors.New("the written file is not a kdbx file")
+	}
+	if verify == nil {
+		return nil
+	}
+	return verify(written)
+}
+
+// syncs the directory, so the rename is on the disk as well
+// not every system supports this, so errors are only logged
+func syncDirectory(path string){
+	dir, err := os.Open(path)
+	if err != nil{
+		log.Println("The directory could not be opened for the sync: ", err)
+		return
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil{
+		log.Println("The directory could not be synced: ", err)
+	}
+}
+
+// checks if the server can open the file with its credentials
+// in the end-to-end mode the server can't open the file, so only the signature is checked
+func verifyServerFile(file []byte) error{
+	if cfg.Keepass.EndToEnd {
+		return nil
+	}
+
+	credentials, err := serverCredentials()
+	if err != nil{
+		return err
+	}
+	db, err := unlockDatabase(file, credentials)
+	if err != nil{
+		return err
+	}
+	LockDatabase(db)
+	return nil
+}
+
+// VerifyClientFile checks if the client can open the file with the credentials of its local file
+// a client which doesn't know the credentials of its file passes nil, then only the signature is checked
+func VerifyClientFile(file []byte, credentials *gokeepasslib.DBCredentials) error{
+	if credentials == nil {
+		return nil
+	}
+
+	db, err := unlockDatabase(file, credentials)
+	if err != nil{
+		return err
+	}
+	LockDatabase(db)
+	return nil
+}
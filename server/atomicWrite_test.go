@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	file, err := os.ReadFile("../merge/testdata/server.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.kdbx")
+	if err := os.WriteFile(path, []byte("old file"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failing verification and a file which isn't a kdbx file keep the old file
+	failing := func(written []byte) error { return errors.New("broken file") }
+	if err := WriteFileAtomically(path, file, failing); err == nil {
+		t.Error("expected the error of the verification")
+	}
+	if err := WriteFileAtomically(path, []byte("no kdbx file"), nil); err == nil {
+		t.Error("expected an error for a file without the kdbx signature")
+	}
+	if written, _ := os.ReadFile(path); string(written) != "old file" {
+		t.Errorf("expected the old file after the failed writes, got %q", written)
+	}
+
+	if err := WriteFileAtomically(path, file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := os.ReadFile(path); !bytes.Equal(written, file) {
+		t.Error("expected the new file")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("expected the permissions of the old file, got %v", info.Mode().Perm())
+	}
+
+	// no temporary files are left in the directory
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the keepass file in the directory, got %d files", len(files))
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"github.com/tobischo/gokeepasslib/v3"
+	"io/ioutil"
+	"strings"
+)
+
+// keyFileXML represents the xml key files of keepass (version 1.0 and 2.0)
+type keyFileXML struct {
+	Meta struct {
+		Version string `xml:"Version"`
+	} `xml:"Meta"`
+	Key struct {
+		Data string `xml:"Data"`
+	} `xml:"Key"`
+}
+
+// CreateCredentials creates the credentials for a keepass file, which can be a password, a key file or both
+// if no key file is given only the password is used, even if it is empty
+func CreateCredentials(password string, keyFilePath string) (*gokeepasslib.DBCredentials, error){
+	if keyFilePath == "" {
+		return gokeepasslib.NewPasswordCredentials(password), nil
+	}
+
+	key, err := parseKeyFile(keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a password only the key file is used
+	credentials := &gokeepasslib.DBCredentials{Key: key}
+	if password != "" {
+		credentials.Passphrase = gokeepasslib.NewPasswordCredentials(password).Passphrase
+	}
+	return credentials, nil
+}
+
+// returns the key of a keepass key file
+// gokeepasslib.ParseKeyFile is not used, because it hashes the content of xml, binary and hex key files
+// instead of using the key in these files like keepass does
+func parseKeyFile(path string) ([]byte, error){
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyFile keyFileXML
+	if xml.Unmarshal(file, &keyFile) == nil && keyFile.Key.Data != "" {
+		data := strings.TrimSpace(keyFile.Key.Data)
+		// version 2.0 stores the key as hex with whitespaces, version 1.0 as base64
+		if strings.HasPrefix(keyFile.Meta.Version, "2.") {
+			return hex.DecodeString(strings.Join(strings.Fields(data), ""))
+		}
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	// a binary key with 32 bytes or a hex key with 64 characters is used directly
+	if len(file) == 32 {
+		return file, nil
+	}
+	if trimmed := bytes.TrimSpace(file); len(trimmed) == 64 {
+		if key, err := hex.DecodeString(string(trimmed)); err == nil {
+			return key, nil
+		}
+	}
+
+	// every other file is hashed
+	hash := sha256.Sum256(file)
+	return hash[:], nil
+}
+
+// returns the credentials of the keepass file on the server from the config
+func serverCredentials() (*gokeepasslib.DBCredentials, error){
+	return CreateCredentials(cfg.Keepass.Password, cfg.Keepass.KeyFile)
+}
+
+// returns the credentials which the client sent for its keepass file
+// if the client didn't send credentials, the client file uses the same credentials as the server file
+func clientCredentials(p Payload) (*gokeepasslib.DBCredentials, error){
+	if p.Credentials == nil {
+		return serverCredentials()
+	}
+	return &gokeepasslib.DBCredentials{
+		Passphrase: p.Credentials.Passphrase,
+		Key:        p.Credentials.Key,
+	}, nil
+}
+
+// encrypts a server file with the credentials of the client
+func encryptForClient(serverFile []byte, p Payload) ([]byte, error){
+	server, err := serverCredentials()
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientCredentials(p)
+	if err != nil {
+		return nil, err
+	}
+	return reencryptFile(serverFile, server, client)
+}
+
+// encrypts a client file with the credentials of the server
+func encryptForServer(clientFile []byte, p Payload) ([]byte, error){
+	server, err := serverCredentials()
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientCredentials(p)
+	if err != nil {
+		return nil, err
+	}
+	return reencryptFile(clientFile, client, server)
+}
+
+// decrypts a keepass file with the old credentials and encrypts it with the new credentials
+// the protected entries don't need to be unlocked, because they are encrypted with the inner stream key of the file
+func reencryptFile(file []byte, oldCredentials *gokeepasslib.DBCredentials, newCredentials *gokeepasslib.DBCredentials) ([]byte, error){
+	if equalCredentials(oldCredentials, newCredentials) {
+		return file, nil
+	}
+
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = oldCredentials
+	if err := gokeepasslib.NewDecoder(bytes.NewReader(file)).Decode(db); err != nil {
+		return nil, err
+	}
+
+	db.Credentials = newCredentials
+	var encrypted bytes.Buffer
+	if err := gokeepasslib.NewEncoder(&encrypted).Encode(db); err != nil {
+		return nil, err
+	}
+	return encrypted.Bytes(), nil
+}
+
+// checks if both credentials create the same composite key
+func equalCredentials(a *gokeepasslib.DBCredentials, b *gokeepasslib.DBCredentials) bool{
+	return bytes.Equal(a.Passphrase, b.Passphrase) && bytes.Equal(a.Key, b.Key) && bytes.Equal(a.Windows, b.Windows)
+}
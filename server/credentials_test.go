@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+const testPassword = "abcdefg12345678"
+
+func TestParseKeyFile(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	hash := sha256.Sum256([]byte("some random file"))
+
+	keyFiles := map[string]struct {
+		content  string
+		expected []byte
+	}{
+		"xml version 1.0": {
+			"<KeyFile><Meta><Version>1.00</Version></Meta><Key><Data>q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=</Data></Key></KeyFile>",
+			key,
+		},
+		"xml version 2.0": {
+			"<KeyFile><Meta><Version>2.0</Version></Meta><Key><Data Hash=\"00000000\">\n" +
+				"ABABABAB ABABABAB ABABABAB ABABABAB\nABABABAB ABABABAB ABABABAB ABABABAB\n</Data></Key></KeyFile>",
+			key,
+		},
+		"binary":         {string(key), key},
+		"hex":            {"abababababababababababababababababababababababababababababababab\n", key},
+		"any other file": {"some random file", hash[:]},
+	}
+
+	for name, keyFile := range keyFiles {
+		path := filepath.Join(t.TempDir(), "key")
+		if err := os.WriteFile(path, []byte(keyFile.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := parseKeyFile(path)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(parsed, keyFile.expected) {
+			t.Errorf("%s: expected %x, got %x", name, keyFile.expected, parsed)
+		}
+	}
+}
+
+func TestReencryptFile(t *testing.T) {
+	file, err := os.ReadFile("../merge/testdata/client.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCredentials := gokeepasslib.NewPasswordCredentials(testPassword)
+	newCredentials := gokeepasslib.NewPasswordCredentials("client password")
+	encrypted, err := reencryptFile(file, oldCredentials, newCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unlockDatabase(encrypted, oldCredentials); err == nil {
+		t.Error("expected the old credentials to be rejected")
+	}
+	db, err := unlockDatabase(encrypted, newCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the protected fields are still readable after the inner stream was re-encrypted
+	if pin := db.Content.Root.Groups[0].Entries[0].GetContent("PIN"); pin != "1234" {
+		t.Errorf("expected the PIN 1234, got %q", pin)
+	}
+}
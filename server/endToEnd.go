@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"github.com/tobischo/gokeepasslib/v3"
+	m "local-pass-sync/merge"
+	"log"
+)
+
+// in the end-to-end mode the server only stores the signed keepass file and never opens it,
+// the client downloads the server file, merges it with the same rules as the compare endpoint and uploads the result
+
+// MergeFiles merges the local keepass file with the remote file of the server like the compare endpoint does
+// the base file is the remote file of the last sync and can be nil, the base of the options is set from it
+// all files are opened with the given credentials, if the result is changed
+// the returned merged file has to replace the local and the remote file
+func MergeFiles(localFile []byte, remoteFile []byte, baseFile []byte, credentials *gokeepasslib.DBCredentials, opts m.Options) ([]byte, m.Result, error){
+	localDb, err := unlockDatabase(localFile, credentials)
+	if err != nil{
+		return nil, m.Result{}, err
+	}
+	remoteDb, err := unlockDatabase(remoteFile, credentials)
+	if err != nil{
+		return nil, m.Result{}, err
+	}
+
+	opts.Base = nil
+	if baseFile != nil{
+		// without the base the entries are merged by their modification time
+		if opts.Base, err = unlockDatabase(baseFile, credentials); err != nil{
+			log.Println("The sync base could not be unlocked: ", err)
+			opts.Base = nil
+		}
+	}
+
+	result, err := m.Merge(localDb, remoteDb, opts)
+	LockDatabase(localDb)
+	if err != nil || !result.Changed{
+		LockDatabase(remoteDb)
+		return remoteFile, result, err
+	}
+
+	merged, err := encodeDatabase(remoteDb)
+	return merged, result, err
+}
+
+// CompareFiles returns the changes of the remote file if the local file would replace it
+// both files are opened with the given credentials
+func CompareFiles(remoteFile []byte, localFile []byte, credentials *gokeepasslib.DBCredentials) ([]m.Change, error){
+	localDb, err := unlockDatabase(localFile, credentials)
+	if err != nil{
+		return nil, err
+	}
+	remoteDb, err := unlockDatabase(remoteFile, credentials)
+	if err != nil{
+		return nil, err
+	}
+	return m.Compare(remoteDb, localDb)
+}
+
+// DiffFiles returns the differences of two local keepass files with the same rules as the merge
+// every file is opened with its own credentials, the server config is not used
+func DiffFiles(firstFile []byte, firstCredentials *gokeepasslib.DBCredentials, secondFile []byte, secondCredentials *gokeepasslib.DBCredentials) ([]m.Change, error){
+	firstDb, err := unlockDatabase(firstFile, firstCredentials)
+	if err != nil{
+		return nil, err
+	}
+	secondDb, err := unlockDatabase(secondFile, secondCredentials)
+	if err != nil{
+		return nil, err
+	}
+	return m.Compare(firstDb, secondDb)
+}
+
+// locks the db and returns the encoded keepass file
+func encodeDatabase(db *gokeepasslib.Database) ([]byte, error){
+	if err := db.LockProtectedEntries(); err != nil{
+		return nil, err
+	}
+
+	var file bytes.Buffer
+	if err := gokeepasslib.NewEncoder(&file).Encode(db); err != nil{
+		return nil, err
+	}
+	return file.Bytes(), nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	c "local-pass-sync/config"
+)
+
+func TestMergeFiles(t *testing.T) {
+	localFile, err := os.ReadFile("../merge/testdata/client.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteFile, err := os.ReadFile("../merge/testdata/server.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config c.Config
+	credentials := gokeepasslib.NewPasswordCredentials(testPassword)
+	merged, result, err := MergeFiles(localFile, remoteFile, nil, credentials, MergeOptions(config, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Changed {
+		t.Fatal("expected the files to be changed")
+	}
+
+	db, err := unlockDatabase(merged, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := db.Content.Root.Groups[0].Entries[0].GetPassword(); password != "new-password" {
+		t.Errorf("expected the newer local password, got %q", password)
+	}
+
+	// the merged file is the same on both sides, so the next merge doesn't change anything
+	if _, result, err := MergeFiles(merged, merged, merged, credentials, MergeOptions(config, "")); err != nil || result.Changed {
+		t.Errorf("expected no changes after the merge, got %+v %v", result.Changes, err)
+	}
+}
+
+// the merged kdbx 4 file keeps the attachments in its inner header
+func TestMergeFilesWithKdbx4File(t *testing.T) {
+	localFile, err := os.ReadFile("../merge/testdata/client.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteFile, err := os.ReadFile("../merge/testdata/kdbx4.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := gokeepasslib.NewPasswordCredentials(testPassword)
+	merged, result, err := MergeFiles(localFile, remoteFile, nil, credentials, MergeOptions(c.Config{}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Changed {
+		t.Fatal("expected the entries of the local file to be added")
+	}
+
+	db, err := unlockDatabase(merged, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.Header.IsKdbx4() {
+		t.Fatal("expected the format of the remote file")
+	}
+	entries := db.Content.Root.Groups[0].Entries
+	if len(entries) != 2 || len(entries[0].Binaries) != 2 {
+		t.Fatalf("expected the remote entry with its attachments and the local entry, got %d entries", len(entries))
+	}
+	for _, reference := range entries[0].Binaries {
+		binary := db.FindBinary(reference.Value.ID)
+		if binary == nil {
+			t.Fatalf("the binary of the attachment %s is missing", reference.Name)
+		}
+		if content, err := binary.GetContentString(); err != nil || content != "recovery codes" {
+			t.Errorf("attachment %s: expected the content of the kdbx 4 file, got %q %v", reference.Name, content, err)
+		}
+	}
+}
+
+// both files are opened with their own credentials
+func TestDiffFilesWithDifferentCredentials(t *testing.T) {
+	firstFile, err := os.ReadFile("../merge/testdata/server.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFile, err := os.ReadFile("../merge/testdata/client.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstCredentials := gokeepasslib.NewPasswordCredentials(testPassword)
+	secondCredentials := gokeepasslib.NewPasswordCredentials("second password")
+	secondFile, err := reencryptFile(clientFile, firstCredentials, secondCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := DiffFiles(firstFile, firstCredentials, secondFile, secondCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Error("expected the changes of the second file")
+	}
+	if _, err := DiffFiles(firstFile, firstCredentials, secondFile, firstCredentials); err == nil {
+		t.Error("expected the second file to be rejected with the credentials of the first file")
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/tobischo/gokeepasslib/v3"
+	"io/ioutil"
+	k "local-pass-sync/key"
+	m "local-pass-sync/merge"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// the entry devices are the keys which changed the entries of the server file last
+// the conflict copies of the duplicate policy name them, because the server itself never changes an entry
+// they are stored next to the sync bases, because the policy only creates conflict copies with a sync base
+
+// returns the path of the entry devices, it is empty if the sync bases are disabled
+func entryDevicesPath() string{
+	directory := syncBaseDirectory()
+	if directory == ""{
+		return ""
+	}
+	return filepath.Join(directory, "entryDevices.json")
+}
+
+// loads the devices which changed the server entries last
+// returns nil if the sync base is disabled or no client changed an entry yet
+func loadEntryDevices() map[gokeepasslib.UUID]string{
+	path := entryDevicesPath()
+	if path == ""{
+		return nil
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if err != nil{
+		if !os.IsNotExist(err){
+			log.Println("The devices of the entries could not be read: ", err)
+		}
+		return nil
+	}
+
+	var stored map[string]string
+	if err := json.Unmarshal(file, &stored); err != nil{
+		log.Println("The devices of the entries could not be parsed: ", err)
+		return nil
+	}
+
+	devices := make(map[gokeepasslib.UUID]string, len(stored))
+	for id, device := range stored{
+		var uuid gokeepasslib.UUID
+		if decoded, err := hex.DecodeString(id); err == nil && len(decoded) == len(uuid){
+			copy(uuid[:], decoded)
+			devices[uuid] = device
+		}
+	}
+	return devices
+}
+
+// records the client as the device of the entries which it changed on the server
+// a change without a winner comes from a replacement, so the client changed the entry as well
+func saveEntryDevices(clientKey string, changes []m.Change){
+	path := entryDevicesPath()
+	if path == "" || len(changes) == 0{
+		return
+	}
+
+	stored := make(map[string]string)
+	for uuid, device := range loadEntryDevices(){
+		stored[hex.EncodeToString(uuid[:])] = device
+	}
+	device := "key " + k.Fingerprint(clientKey)
+	for _, change := range changes{
+		if change.Group {
+			continue
+		}
+		if change.Type == m.Deleted {
+			delete(stored, change.UUID)
+			continue
+		}
+		if change.Winner == m.Local || change.Winner == m.Both || change.Winner == ""{
+			stored[change.UUID] = device
+		}
+	}
+
+	file, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil{
+		log.Println("The devices of the entries could not be created: ", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil{
+		log.Println("The directory for the devices of the entries could not be created: ", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, file, 0600); err != nil{
+		log.Println("The devices of the entries could not be saved: ", err)
+	}
+}
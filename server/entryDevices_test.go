@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	c "local-pass-sync/config"
+	k "local-pass-sync/key"
+	m "local-pass-sync/merge"
+)
+
+// the client becomes the device of the entries which it changed, deleted entries are forgotten
+func TestSaveEntryDevices(t *testing.T) {
+	defer func() { cfg = c.Config{} }()
+	cfg.Keepass.SyncBasePath = t.TempDir()
+
+	changed, kept, deleted := gokeepasslib.NewUUID(), gokeepasslib.NewUUID(), gokeepasslib.NewUUID()
+	id := func(uuid gokeepasslib.UUID) string { return hex.EncodeToString(uuid[:]) }
+
+	saveEntryDevices("firstKey", []m.Change{
+		{Type: m.Added, UUID: id(kept), Winner: m.Local},
+		{Type: m.Added, UUID: id(deleted), Winner: m.Local},
+	})
+	saveEntryDevices("secondKey", []m.Change{
+		{Type: m.Updated, UUID: id(changed), Winner: m.Both},
+		{Type: m.Updated, UUID: id(kept), Winner: m.Remote},
+		{Type: m.Deleted, UUID: id(deleted), Winner: m.Local},
+	})
+
+	devices := loadEntryDevices()
+	expected := map[gokeepasslib.UUID]string{
+		changed: "key " + k.Fingerprint("secondKey"),
+		kept:    "key " + k.Fingerprint("firstKey"),
+	}
+	if len(devices) != len(expected) {
+		t.Fatalf("expected %d entry devices, got %v", len(expected), devices)
+	}
+	for uuid, device := range expected {
+		if devices[uuid] != device {
+			t.Errorf("expected the device %q, got %q", device, devices[uuid])
+		}
+	}
+
+	cfg.Keepass.DisableSyncBase = true
+	if loadEntryDevices() != nil {
+		t.Error("expected no entry devices without a sync base")
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	m "local-pass-sync/merge"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the file history keeps every keepass file which the server accepted, so a bad upload can be undone
+// every version is stored as <id>.kdbx with its metadata in <id>.json in the history directory
+
+// operations which create a new version of the server file
+const (
+	// the server file which existed before the first version was saved
+	initialOperation = "initial"
+	compareOperation = "compare"
+	replaceOperation = "replace"
+	restoreOperation = "restore"
+)
+
+// RestoreMessage is the prefix of the signed message, which the client sends with the id of the version to restore
+const RestoreMessage = "restore version "
+
+// ListHistoryMessage is the message which the client signs to list the versions
+const ListHistoryMessage = "list history"
+
+// FileVersion contains the metadata of a version of the server file
+type FileVersion struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Key is the public key of the client which uploaded or restored the version
+	Key       string `json:"key,omitempty"`
+	Operation string `json:"operation"`
+	// Summary contains the number of changed entries, e.g. "1 added, 2 updated"
+	Summary string `json:"summary,omitempty"`
+}
+
+// ListHistory returns the metadata of all versions of the server file, the newest version is the first
+func (h *userHandler) ListHistory(w http.ResponseWriter, r *http.Request) error{
+	p, ok, err := h.verifyHistoryRequest(w, r)
+	if err != nil || !ok {
+		return err
+	}
+	if p.Message != ListHistoryMessage {
+		payload := createResponse("", nil, "", "The message has to be \""+ListHistoryMessage+"\".")
+		return sendResponseToClient(w, payload, 400)
+	}
+
+	versions, err := listVersions()
+	if err != nil{
+		internalServerError(w)
+		return err
+	}
+
+	payload := marshalResponse(Payload{Message: fmt.Sprintf("The server has %d versions.", len(versions)), History: versions, Version: serverFileVersion()})
+	return sendResponseToClient(w, payload, 200)
+}
+
+// RestoreVersion replaces the server file with a version of the history
+// the restored file is saved as a new version, so the restore can be undone as well
+// the sync bases of all clients are removed, because they describe the file before the restore
+func (h *userHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) error{
+	p, ok, err := h.verifyHistoryRequest(w, r)
+	if err != nil || !ok {
+		return err
+	}
+
+	// the id is part of the signed message, so a signature can't be used to restore another version
+	id := strings.TrimPrefix(p.Message, RestoreMessage)
+	version, file, err := readVersion(id)
+	if !strings.HasPrefix(p.Message, RestoreMessage) || os.IsNotExist(err) {
+		payload := createResponse("", nil, "", "There is no version "+id+".")
+		return sendResponseToClient(w, payload, 404)
+	}
+	if err != nil{
+		internalServerError(w)
+		return err
+	}
+
+	saveInitialVersion()
+	if err := WriteFileAtomically(cfg.Keepass.ServerPath, file, verifyServerFile); err != nil{
+		internalServerError(w)
+		return err
+	}
+	// the sync bases are kept, the fields which a client didn't change since its base take the restored values with the next merge
+	saveVersion(file, p.Key, restoreOperation, "restored version "+version.ID)
+
+	resp := createVersionedResponse(nil, fileVersion(file), "Version "+version.ID+" was restored on the server. "+
+		"Run getFile on every client, otherwise entries which were added after this version are synced again.")
+	return sendResponseToClient(w, resp, 200)
+}
+
+// decodes the payload of a history request and verifies the signature of its message
+// the returned boolean is false if a response was already sent to the client
+func (h *userHandler) verifyHistoryRequest(w http.ResponseWriter, r *http.Request) (Payload, bool, error){
+	p, body, err := decodeRequest(r)
+	if err != nil {
+		internalServerError(w)
+		return p, false, err
+	}
+
+	if cfg.Keepass.HistoryPath == "" {
+		payload := createResponse("", nil, "", "The server doesn't keep a history of the file.")
+		return p, false, sendResponseToClient(w, payload, 400)
+	}
+
+	// checks if the public is in the authorized keys and gets ed25519.PublicKey from the map if it is there
+	publicKey, ok := h.store.pk[p.Key]
+	if !ok {
+		payload := createResponse("", nil, "", "You are not authorized!")
+		return p, false, sendResponseToClient(w, payload, 401)
+	}
+
+	err, verified := verifyRequest(w, r, body, publicKey)
+	return p, verified, err
+}
+
+// saves the server file as the first version, if the history is empty
+// otherwise the file which existed before the history was configured would be lost with the next change
+func saveInitialVersion(){
+	if cfg.Keepass.HistoryPath == "" {
+		return
+	}
+	if versions, err := listVersions(); err != nil || len(versions) > 0 {
+		return
+	}
+
+	file, err := ioutil.ReadFile(cfg.Keepass.ServerPath)
+	if err != nil{
+		return
+	}
+	saveVersion(file, "", initialOperation, "")
+}
+
+// saves the file with its metadata in the history and removes the versions which are older than the retention allows
+// errors are only logged, because the file was already saved on the server
+func saveVersion(file []byte, key string, operation string, summary string){
+	if cfg.Keepass.HistoryPath == "" {
+		return
+	}
+
+	if err := os.MkdirAll(cfg.Keepass.HistoryPath, 0700); err != nil{
+		log.Println("The history directory could not be created: ", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	version := FileVersion{
+		ID:        now.Format("20060102T150405.000000000Z"),
+		Time:      now,
+		Key:       key,
+		Operation: operation,
+		Summary:   summary,
+	}
+	metadata, err := json.MarshalIndent(version, "", "  ")
+	if err != nil{
+		log.Println("The metadata of the version could not be created: ", err)
+		return
+	}
+
+	path := filepath.Join(cfg.Keepass.HistoryPath, version.ID)
+	if err := ioutil.WriteFile(path+".kdbx", file, 0600); err != nil{
+		log.Println("The version could not be saved: ", err)
+		return
+	}
+	if err := ioutil.WriteFile(path+".json", metadata, 0600); err != nil{
+		log.Println("The metadata of the version could not be saved: ", err)
+		return
+	}
+
+	removeOldVersions()
+}
+
+// returns the metadata of all versions in the history, the newest version is the first
+func listVersions() ([]FileVersion, error){
+	files, err := ioutil.ReadDir(cfg.Keepass.HistoryPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil{
+		return nil, err
+	}
+
+	var versions []FileVersion
+	for _, file := range files{
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		metadata, err := ioutil.ReadFile(filepath.Join(cfg.Keepass.HistoryPath, file.Name()))
+		if err != nil{
+			return nil, err
+		}
+		var version FileVersion
+		if err := json.Unmarshal(metadata, &version); err != nil{
+			log.Printf("The metadata %s of the history could not be read: %s", file.Name(), err)
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions, nil
+}
+
+// returns the metadata and the file of a version
+// only ids of the history are accepted, so the id can't point to a file outside of the history
+func readVersion(id string) (FileVersion, []byte, error){
+	versions, err := listVersions()
+	if err != nil{
+		return FileVersion{}, nil, err
+	}
+	for _, version := range versions{
+		if version.ID == id {
+			file, err := ioutil.ReadFile(filepath.Join(cfg.Keepass.HistoryPath, version.ID+".kdbx"))
+			return version, file, err
+		}
+	}
+	return FileVersion{}, nil, os.ErrNotExist
+}
+
+// removes the versions which exceed the maximum number of versions or are older than the maximum age
+// the newest version is always kept
+func removeOldVersions(){
+	versions, err := listVersions()
+	if err != nil{
+		log.Println("The history could not be read: ", err)
+		return
+	}
+
+	deleteBefore := time.Now().AddDate(0, 0, -cfg.Keepass.HistoryMaxDays)
+	for i, version := range versions{
+		if i == 0 {
+			continue
+		}
+		tooMany := cfg.Keepass.HistoryMaxVersions > 0 && i >= cfg.Keepass.HistoryMaxVersions
+		tooOld := cfg.Keepass.HistoryMaxDays > 0 && version.Time.Before(deleteBefore)
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		path := filepath.Join(cfg.Keepass.HistoryPath, version.ID)
+		for _, name := range []string{path + ".kdbx", path + ".json"}{
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err){
+				log.Println("An old version could not be removed: ", err)
+			}
+		}
+	}
+}
+
+// summarizes the changes of the entries, e.g. "1 added, 2 updated"
+func summarizeChanges(changes []m.Change) string{
+	counts := make(map[string]int)
+	for _, change := range changes{
+		if !change.Group {
+			counts[change.Type]++
+		}
+	}
+
+	var parts []string
+	for _, changeType := range []string{m.Added, m.Updated, m.Deleted, m.Moved, m.Conflict}{
+		if counts[changeType] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[changeType], changeType))
+		}
+	}
+	if len(parts) == 0 {
+		return "no entries changed"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// compares the entries of the old file with the new file which replaces it
+// returns false in the end-to-end mode or if the files can't be opened
+func replacementChanges(oldFile []byte, newFile []byte) ([]m.Change, bool){
+	if cfg.Keepass.EndToEnd || oldFile == nil {
+		return nil, false
+	}
+
+	credentials, err := serverCredentials()
+	if err != nil{
+		log.Println("The changes of the replacement could not be compared: ", err)
+		return nil, false
+	}
+	newDb, oldDb, err := unlockDatabases(newFile, credentials, oldFile)
+	if err != nil{
+		log.Println("The changes of the replacement could not be compared: ", err)
+		return nil, false
+	}
+
+	changes, err := m.Compare(oldDb, newDb)
+	if err != nil{
+		log.Println("The changes of the replacement could not be compared: ", err)
+		return nil, false
+	}
+	return changes, true
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	c "local-pass-sync/config"
+	m "local-pass-sync/merge"
+)
+
+func TestSaveVersionKeepsMaxVersions(t *testing.T) {
+	defer func() { cfg = c.Config{} }()
+	cfg.Keepass.HistoryPath = t.TempDir()
+	cfg.Keepass.HistoryMaxVersions = 2
+
+	for _, content := range []string{"first", "second", "third"} {
+		saveVersion([]byte(content), "key", replaceOperation, content)
+	}
+
+	versions, err := listVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Summary != "third" || versions[1].Summary != "second" {
+		t.Fatalf("expected the two newest versions, got %+v", versions)
+	}
+
+	version, file, err := readVersion(versions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Key != "key" || version.Operation != replaceOperation || !bytes.Equal(file, []byte("second")) {
+		t.Errorf("unexpected version %+v with the file %q", version, file)
+	}
+	if _, _, err := readVersion("../config"); err == nil {
+		t.Error("expected an error for an id which isn't in the history")
+	}
+}
+
+func TestSummarizeChanges(t *testing.T) {
+	changes := []m.Change{{Type: m.Updated}, {Type: m.Added}, {Type: m.Updated}, {Type: m.Added, Group: true}}
+	if summary := summarizeChanges(changes); summary != "1 added, 2 updated" {
+		t.Errorf("unexpected summary %q", summary)
+	}
+}
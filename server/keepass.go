@@ -2,33 +2,22 @@ package server
 
 import (
 	"bytes"
-	"github.com/tobischo/gokeepasslib"
+	"encoding/base64"
+	"github.com/tobischo/gokeepasslib/v3"
+	c "local-pass-sync/config"
+	k "local-pass-sync/key"
+	m "local-pass-sync/merge"
 	"log"
 	"net/http"
-	"os"
 	"time"
 )
 
-// creates a new key-value pair for an entry
-func mkValue(key string, value string) gokeepasslib.ValueData {
-	return gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value}}
-}
-
-// creates a new key-value pair for an entry which is protected
-// this should be used for passwords
-func mkProtectedValue(key string, value string) gokeepasslib.ValueData {
-	return gokeepasslib.ValueData{
-		Key:   key,
-		Value: gokeepasslib.V{Content: value, Protected: true},
-	}
-}
-
 // returns the readable database file for a keepass file
-func unlockDatabase(keepassFile []byte, password string) (*gokeepasslib.Database, error){
+func unlockDatabase(keepassFile []byte, credentials *gokeepasslib.DBCredentials) (*gokeepasslib.Database, error){
 	reader := bytes.NewReader(keepassFile)
 
 	db := gokeepasslib.NewDatabase()
-	db.Credentials = gokeepasslib.NewPasswordCredentials(password)
+	db.Credentials = credentials
 
 	if err := gokeepasslib.NewDecoder(reader).Decode(db); err != nil{
 		return nil, err
@@ -42,17 +31,14 @@ func unlockDatabase(keepassFile []byte, password string) (*gokeepasslib.Database
 }
 
 // locks the db and saves the keepass file on the given path
+// the file is encoded completely before the old file is replaced, so an encoding error doesn't destroy the old file
 func saveAndLockDatabase(path string, db *gokeepasslib.Database) error{
-	file, err := os.Create(path)
-	if err != nil{
+	file, err := encodeDatabase(db)
+	if err != nil {
 		return err
 	}
 
-	if err := db.LockProtectedEntries(); err != nil { return err }
-
-	//LockProtectedEntries does not need to be called, since the documentation says that Encode already calls it
-	keepassEncoder := gokeepasslib.NewEncoder(file)
-	if err := keepassEncoder.Encode(db); err != nil {
+	if err := WriteFileAtomically(path, file, verifyServerFile); err != nil {
 		return err
 	}
 
@@ -67,109 +53,71 @@ func LockDatabase(db *gokeepasslib.Database){
 	}
 }
 
-// compares two dbs and tracks if there is a difference
-// we are only changing the server file and keeping the client file untouched
-func compareDatabases(clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database) bool{
-	// right now we are only adding and changing entries and not deleting anything
-	serverEntries := getMapForAllEntries(serverDb)
-	fileModified := false
-
-	compareClientAndServerEntries(clientDb.Content.Root.Groups, serverDb, serverEntries, &fileModified)
-
-	return fileModified
-}
-
-// returns a map of all entries in the db
-func getMapForAllEntries(db *gokeepasslib.Database) map[gokeepasslib.UUID] gokeepasslib.Entry{
-	m := make(map[gokeepasslib.UUID]gokeepasslib.Entry)
-	iterateGroup(db.Content.Root.Groups, db, m)
-	return m
-}
-
-// loops through all groups and sub-groups recursively and gathers all entries
-func iterateGroup(group []gokeepasslib.Group, db *gokeepasslib.Database, m map[gokeepasslib.UUID] gokeepasslib.Entry){
-	for _, element := range group{
-		for _, entry := range element.Entries{
-			m[entry.UUID] = entry
-		}
-		iterateGroup(element.Groups, db, m)
-	}
-}
-
-//  loops through all groups and sub-groups recursively and compares the entries with a given map
-func compareClientAndServerEntries(clientGroup []gokeepasslib.Group, serverDb *gokeepasslib.Database, serverEntries map[gokeepasslib.UUID] gokeepasslib.Entry, fileModified *bool){
-	var keys = []string{"Notes", "Title", "URL", "Username", "UserName"}
-	for _, clientElement := range clientGroup{
-		for _, clientEntry := range clientElement.Entries{
-			// checks if the entries from the client are in the server file
-			if serverEntry, ok := serverEntries[clientEntry.UUID]; ok {
-				compareLastModificationTime(&serverEntry, clientEntry, fileModified, keys)
-			} else {
-				// add the entry to the server file if it doesnt exits
-				createNewEntry(clientEntry, serverDb, keys, fileModified)
-			}
-		}
-		compareClientAndServerEntries(clientElement.Groups, serverDb, serverEntries, fileModified)
+// merges the client db into the server db with the conflict policy and the recycle bin setting of the config
+// the base db is the last file the client got from the server, it is nil if the server doesn't know this file
+func compareDatabases(clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database, baseDb *gokeepasslib.Database, clientKey string) (m.Result, error){
+	opts := MergeOptions(cfg, clientKey)
+	opts.Base = baseDb
+	opts.RemoteEntryDevices = loadEntryDevices()
+	result, err := m.Merge(clientDb, serverDb, opts)
+	// the merge skips the attachments which can't be copied, the server only logs them
+	for _, mergeErr := range result.Errors{
+		log.Println("While merging the client file, the following error occurred: ", mergeErr)
 	}
+	return result, err
 }
 
-// changes the server entry if the client has a newer version of this entry
-func compareLastModificationTime(serverEntry *gokeepasslib.Entry, clientEntry gokeepasslib.Entry, fileModified *bool, keys []string){
-	if time.Time(*clientEntry.Times.LastModificationTime).After(time.Time(*serverEntry.Times.LastModificationTime)) {
-		// change ServerEntry
-		additionalKeys := append(keys, "Password")
-
-		// looping through the keys and set the client values on the server entry values
-		for _, key := range additionalKeys{
-			if index := clientEntry.GetIndex(key); index != -1 {
-				serverEntry.Values[index].Value.Content = clientEntry.Values[index].Value.Content
-			}
-		}
-
-		*serverEntry.Times.LastModificationTime = *clientEntry.Times.LastModificationTime
-		*fileModified = true
-	} else if time.Time(*serverEntry.Times.LastModificationTime).After(time.Time(*clientEntry.Times.LastModificationTime))  {
-		// we dont need to change something if a newer version of an entry is on the server because we are returning the server file
-		// but we have to know that the client needs a new version
-		*fileModified = true
+// MergeOptions returns the conflict policy and the recycle bin setting of the config as merge options without a base
+// the conflict copies of the client are marked with the fingerprint of its public key
+func MergeOptions(cf c.Config, clientKey string) m.Options{
+	return m.Options{
+		ConflictPolicy:       cf.Keepass.ConflictPolicy,
+		LocalDevice:          "key " + k.Fingerprint(clientKey),
+		RemoteDevice:         "server",
+		EmptyRecycleBinAfter: time.Duration(cf.Keepass.EmptyRecycleBinAfterDays) * 24 * time.Hour,
 	}
 }
 
-// creates a new gokeepasslib entry with the client entry values and writes it to the given server db
-func createNewEntry(clientEntry gokeepasslib.Entry, serverDb *gokeepasslib.Database, keys []string, fileModified *bool){
-	entry := gokeepasslib.NewEntry()
-	for _, key := range keys{
-		if index := clientEntry.GetIndex(key); index != -1 {
-			entry.Values = append(entry.Values, mkValue(key, clientEntry.Values[index].Value.Content))
-		}
+// unlocks the client and server database and returns the pointer for both
+// the client database is unlocked with the given client credentials and the server database with the server credentials
+func unlockDatabases(clientFile []byte, clientCredentials *gokeepasslib.DBCredentials, serverFile []byte) (*gokeepasslib.Database, *gokeepasslib.Database, error){
+	clientDb, err := unlockDatabase(clientFile, clientCredentials)
+	if err != nil{
+		return nil, nil, err
 	}
 
-	index := clientEntry.GetIndex("Password")
-	entry.Values = append(entry.Values, mkProtectedValue("Password", clientEntry.Values[index].Value.Content))
-
-	serverDb.Content.Root.Groups[0].Entries = append(serverDb.Content.Root.Groups[0].Entries, entry)
-	*fileModified = true
-}
-
-// unlocks the client and server database and returns the pointer for both
-func unlockDatabases(clientFile []byte, serverFile []byte) (*gokeepasslib.Database, *gokeepasslib.Database, error){
-	clientDb, err := unlockDatabase(clientFile, cfg.Keepass.Password)
+	credentials, err := serverCredentials()
 	if err != nil{
 		return nil, nil, err
 	}
 
-	serverDb, err := unlockDatabase(serverFile, cfg.Keepass.Password)
+	serverDb, err := unlockDatabase(serverFile, credentials)
 	return clientDb, serverDb, err
 }
 
 // if some client entries are newer than the server entries, we create a new file and send it back to the client
-func createNewKeepassFile(w http.ResponseWriter, clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database) error{
+// the returned file is encrypted with the credentials of the client
+// the changes of the merge are sent with the file
+func createNewKeepassFile(w http.ResponseWriter, clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database, clientCredentials *gokeepasslib.DBCredentials, changes []m.Change) error{
 	LockDatabase(clientDb)
 	if err := saveAndLockDatabase(cfg.Keepass.ServerPath, serverDb); err != nil{
 		return err
 	}
 
-	payload := createResponse("", getServerDb(), "", "File was successfully modified by the server")
-	err := sendResponseToClient(w, payload, 200)
-	return err
+	credentials, err := serverCredentials()
+	if err != nil{
+		return err
+	}
+	clientFile, err := reencryptFile(getServerDb(), credentials, clientCredentials)
+	if err != nil{
+		return err
+	}
+
+	payload := marshalResponse(Payload{
+		File: base64.StdEncoding.EncodeToString(clientFile),
+		Message: "File was successfully modified by the server",
+		Changes: changes,
+		Version: fileVersion(getServerDb()),
+	})
+	return sendResponseToClient(w, payload, 200)
 }
\ No newline at end of file
@@ -2,50 +2,99 @@ package server
 
 import (
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func verifyMessage(w http.ResponseWriter, message string, signature string, publicKey ed25519.PublicKey) (error, bool){
+// the headers of a signed request, the body of the request is signed together with them, see RequestEnvelope
+const (
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+)
 
-	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
-	if err != nil{
-		return err, false
-	}
+// the clock skew which is accepted if the config doesn't set one
+const defaultMaxClockSkew = 5 * time.Minute
 
-	isCorrectVerified := ed25519.Verify(publicKey, []byte(message), decodedSignature)
+// nonces of the verified requests with their timestamp, a nonce is forgotten when its request is too old anyway
+// the nonces are only kept in the memory, so after a restart of the server a request which was captured
+// during the last max clock skew before the restart can be sent again until its timestamp is too old
+var usedNonces = make(map[string]time.Time)
 
-	if !isCorrectVerified {
-		payload := createResponse("", nil, "", "The message could not be verified.\n " +
-			"Maybe you used the wrong private key or the given public key is not your key.")
-		err := sendResponseToClient(w, payload, 401)
-		return err, isCorrectVerified
-	}
+// RequestEnvelope returns the bytes which the client signs for a request
+// the envelope binds the signature to the method, the path, the timestamp, the nonce and the hash of the raw body,
+// so a captured request can't be changed, sent again or sent to another endpoint
+func RequestEnvelope(method string, path string, timestamp int64, nonce string, body []byte) []byte{
+	hash := sha256.Sum256(body)
+	envelope := strings.Join([]string{method, path, strconv.FormatInt(timestamp, 10), nonce, hex.EncodeToString(hash[:])}, "\n")
+	return []byte(envelope)
+}
 
-	return nil, isCorrectVerified
+// reads the body of the request and decodes its payload
+// the raw body is returned as well, because the signature covers these bytes and not the decoded payload
+func decodeRequest(r *http.Request) (Payload, []byte, error){
+	var p Payload
+	body, err := io.ReadAll(r.Body)
+	if err != nil{
+		return p, nil, err
+	}
+	err = json.Unmarshal(body, &p)
+	return p, body, err
 }
 
-// checks if the signature matches the file for the public key which the client has sent,
+// checks the timestamp, the nonce and the signature of the request for the public key which the client has sent,
 // creates a 401 response if it couldn't verify
-func decodeFileAndVerify(w http.ResponseWriter, file string, signature string, publicKey ed25519.PublicKey) ([]byte, error, bool){
-	decodedFile, err := base64.StdEncoding.DecodeString(file)
-	if err != nil{
-		return nil, err, false
+func verifyRequest(w http.ResponseWriter, r *http.Request, body []byte, publicKey ed25519.PublicKey) (error, bool){
+	maxClockSkew := defaultMaxClockSkew
+	if cfg.Server.MaxClockSkewSeconds > 0 {
+		maxClockSkew = time.Duration(cfg.Server.MaxClockSkewSeconds) * time.Second
 	}
 
-	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
-	if err != nil{
-		return nil, err, false
+	now := time.Now()
+	unixTime, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	timestamp := time.Unix(unixTime, 0)
+	if err != nil || timestamp.Before(now.Add(-maxClockSkew)) || timestamp.After(now.Add(maxClockSkew)) {
+		payload := createResponse("", nil, "", "The request is too old or from the future.\n " +
+			"Maybe the clock of the client or the server is wrong.")
+		return sendResponseToClient(w, payload, 401), false
 	}
 
-	isCorrectVerified := ed25519.Verify(publicKey, decodedFile, decodedSignature)
+	nonce := r.Header.Get(NonceHeader)
+	if nonce == "" {
+		payload := createResponse("", nil, "", "The request has no nonce.")
+		return sendResponseToClient(w, payload, 401), false
+	}
+	if _, used := usedNonces[nonce]; used {
+		payload := createResponse("", nil, "", "The request was already sent.")
+		return sendResponseToClient(w, payload, 401), false
+	}
 
-	if !isCorrectVerified {
-		payload := createResponse("", nil, "", "The file could not be verified.\n " +
+	decodedSignature, err := base64.StdEncoding.DecodeString(r.Header.Get(SignatureHeader))
+	envelope := RequestEnvelope(r.Method, r.URL.Path, unixTime, nonce, body)
+	if err != nil || !ed25519.Verify(publicKey, envelope, decodedSignature) {
+		payload := createResponse("", nil, "", "The request could not be verified.\n " +
 			"Maybe you used the wrong private key or the given public key is not your key.")
-		err := sendResponseToClient(w, payload, 401)
-		return nil, err, isCorrectVerified
+		return sendResponseToClient(w, payload, 401), false
 	}
 
-	return decodedFile, nil, isCorrectVerified
-}
\ No newline at end of file
+	// the nonce is only saved for verified requests, otherwise everybody could block the nonces of a client
+	forgetOldNonces(now.Add(-maxClockSkew))
+	usedNonces[nonce] = timestamp
+	return nil, true
+}
+
+// removes the nonces of requests which are older than the given time, these requests are rejected because of their timestamp
+func forgetOldNonces(oldest time.Time){
+	for nonce, timestamp := range usedNonces{
+		if timestamp.Before(oldest) {
+			delete(usedNonces, nonce)
+		}
+	}
+}
@@ -2,21 +2,24 @@ package server
 
 import (
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
-	"github.com/tobischo/gokeepasslib"
+	"github.com/tobischo/gokeepasslib/v3"
 	"io/ioutil"
 	c "local-pass-sync/config"
 	k "local-pass-sync/key"
+	m "local-pass-sync/merge"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"sync"
 )
 
 var (
 	keepassRe = regexp.MustCompile(`^/keepass[/]*$`)
+	historyRe = regexp.MustCompile(`^/keepass/history[/]*$`)
 	cfg            c.Config
 	mut sync.Mutex
 )
@@ -34,6 +37,25 @@ type Payload struct {
 	File string `json:"file"`
 	Signature string `json:"signature"`
 	Message string `json:"message"`
+	// Credentials of the client keepass file, the server credentials are used if they are missing
+	Credentials *Credentials `json:"credentials,omitempty"`
+	// Version of the server file, the server sends it with every response and the client sends the version
+	// which it got last when it replaces the file
+	Version string `json:"version,omitempty"`
+	// Changes of the entries by the compare endpoint, they never contain the values of the fields
+	Changes []m.Change `json:"changes,omitempty"`
+	// DryRun only returns the changes of a compare or replace request without saving anything
+	DryRun bool `json:"dryRun,omitempty"`
+	// Force replaces the server file even if the client didn't send the current version of the server file
+	Force bool `json:"force,omitempty"`
+	// History contains the versions of the server file, the newest version is the first
+	History []FileVersion `json:"history,omitempty"`
+}
+
+// Credentials contains the hashed password and the key of the key file for a keepass file
+type Credentials struct {
+	Passphrase []byte `json:"passphrase,omitempty"`
+	Key        []byte `json:"key,omitempty"`
 }
 
 // Serving saves the config as global variable
@@ -81,6 +103,16 @@ func (h *userHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Println("The following error occurred while calling the getFile endpoint: ", err)
 		}
 		return
+	case r.Method == http.MethodGet && historyRe.MatchString(r.URL.Path):
+		if err := h.ListHistory(w, r); err != nil{
+			log.Println("The following error occurred while calling the history endpoint: ", err)
+		}
+		return
+	case r.Method == http.MethodPost && historyRe.MatchString(r.URL.Path):
+		if err := h.RestoreVersion(w, r); err != nil{
+			log.Println("The following error occurred while calling the restore endpoint: ", err)
+		}
+		return
 	default:
 		notFound(w)
 		return
@@ -90,8 +122,8 @@ func (h *userHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Compare handles the request if the client wants to update there file on the server/localhost
 func (h *userHandler) Compare(w http.ResponseWriter, r *http.Request) error{
 	// encodes json payload
-	var p Payload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+	p, body, err := decodeRequest(r)
+	if err != nil {
 		internalServerError(w)
 		return err
 	}
@@ -104,29 +136,76 @@ func (h *userHandler) Compare(w http.ResponseWriter, r *http.Request) error{
 		return err
 	}
 
-	// Verify ed25519 message and signature
-	clientFile, err, verified := decodeFileAndVerify(w, p.File, p.Signature, publicKey)
+	// Verify ed25519 signature of the request
+	err, verified := verifyRequest(w, r, body, publicKey)
+	if err != nil || !verified {
+		return err
+	}
+	clientFile, err := base64.StdEncoding.DecodeString(p.File)
 	if err != nil{
+		internalServerError(w)
 		return err
 	}
-	if !verified {
-		return nil
+
+	// the server can't open the files in the end-to-end mode
+	if cfg.Keepass.EndToEnd {
+		payload := createResponse("", nil, "", "The server runs in the end-to-end mode, the files are merged by the client.")
+		return sendResponseToClient(w, payload, 400)
 	}
 
-	clientDb, serverDb, err := unlockDatabases(clientFile, getServerDb())
+	clientCredentials, err := clientCredentials(p)
+	if err != nil{
+		internalServerError(w)
+		return err
+	}
 
-	if !compareDatabases(clientDb, serverDb){
-		return closeFilesAndSendResponse(w, clientDb, serverDb)
+	clientDb, serverDb, err := unlockDatabases(clientFile, clientCredentials, getServerDb())
+	if err != nil{
+		internalServerError(w)
+		return err
 	}
 
-	err = createNewKeepassFile(w, clientDb, serverDb)
+	// the last file which was sent to this client is the common base for a field by field merge
+	baseDb := loadSyncBase(p.Key)
 
-	return err
+	result, err := compareDatabases(clientDb, serverDb, baseDb, p.Key)
+	if err != nil{
+		LockDatabase(clientDb)
+		LockDatabase(serverDb)
+		internalServerError(w)
+		return err
+	}
+
+	// a dry run only returns the changes, neither the server file nor the sync base is saved
+	if p.DryRun {
+		LockDatabase(clientDb)
+		LockDatabase(serverDb)
+		payload := marshalResponse(Payload{Message: "Dry run, nothing was saved.", Changes: result.Changes, Version: serverFileVersion()})
+		return sendResponseToClient(w, payload, 200)
+	}
+
+	if !result.Changed{
+		err = closeFilesAndSendResponse(w, clientDb, serverDb)
+	} else {
+		saveInitialVersion()
+		err = createNewKeepassFile(w, clientDb, serverDb, clientCredentials, result.Changes)
+	}
+	if err != nil{
+		return err
+	}
+	if result.Changed{
+		saveVersion(getServerDb(), p.Key, compareOperation, summarizeChanges(result.Changes))
+		saveEntryDevices(p.Key, result.Changes)
+	}
+
+	// in both cases the client has now the same entries as the server file
+	saveSyncBase(p.Key, getServerDb())
+	return nil
 }
 
 func (h *userHandler) GetFile(w http.ResponseWriter, r *http.Request) error{
-	var p Payload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+	p, body, err := decodeRequest(r)
+	if err != nil {
 		internalServerError(w)
 		return err
 	}
@@ -139,24 +218,36 @@ func (h *userHandler) GetFile(w http.ResponseWriter, r *http.Request) error{
 		return err
 	}
 
-	err, verified := verifyMessage(w, p.Message, p.Signature, publicKey)
-	if err != nil{
+	err, verified := verifyRequest(w, r, body, publicKey)
+	if err != nil || !verified {
 		return err
 	}
-	if !verified {
-		return nil
-	}
 
+	// the file is encrypted with the credentials of the client, in the end-to-end mode the file is returned unchanged
 	file := getServerDb()
-	resp := createResponse("", file, "", "File successfully returned from server.")
-	err = sendResponseToClient(w, resp, 200)
+	clientFile := file
+	if !cfg.Keepass.EndToEnd {
+		clientFile, err = encryptForClient(file, p)
+		if err != nil{
+			internalServerError(w)
+			return err
+		}
+	}
 
-	return err
+	resp := createVersionedResponse(clientFile, fileVersion(file), "File successfully returned from server.")
+	if err = sendResponseToClient(w, resp, 200); err != nil{
+		return err
+	}
+
+	if !cfg.Keepass.EndToEnd {
+		saveSyncBase(p.Key, file)
+	}
+	return nil
 }
 
 func (h *userHandler) ReplaceFile(w http.ResponseWriter, r *http.Request) interface{} {
-	var p Payload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+	p, body, err := decodeRequest(r)
+	if err != nil {
 		internalServerError(w)
 		return err
 	}
@@ -169,31 +260,100 @@ func (h *userHandler) ReplaceFile(w http.ResponseWriter, r *http.Request) interf
 		return err
 	}
 
-	// Verify ed25519 message and signature
-	clientFile, err, verified := decodeFileAndVerify(w, p.File, p.Signature, publicKey)
+	// Verify ed25519 signature of the request
+	err, verified := verifyRequest(w, r, body, publicKey)
+	if err != nil || !verified {
+		return err
+	}
+	clientFile, err := base64.StdEncoding.DecodeString(p.File)
 	if err != nil{
+		internalServerError(w)
 		return err
 	}
-	if !verified {
-		return nil
+
+	// a client only replaces the file if nobody changed it since the client got its version, unless the replacement is forced
+	if !p.Force && p.Version != serverFileVersion() {
+		payload := createVersionedResponse(nil, serverFileVersion(), "The file on the server was changed since your last sync. " +
+			"Run compareFiles first or replaceFile --force to overwrite the changes on the server.")
+		return sendResponseToClient(w, payload, 409)
+	}
+
+	if p.DryRun {
+		return sendReplacementPreview(w, clientFile, p)
 	}
 
-	err = os.WriteFile(cfg.Keepass.ServerPath, clientFile, 0644)
+	// the file is stored with the credentials of the server, in the end-to-end mode the file is stored unchanged
+	serverFile := clientFile
+	if !cfg.Keepass.EndToEnd {
+		serverFile, err = encryptForServer(clientFile, p)
+		if err != nil{
+			internalServerError(w)
+			return err
+		}
+	}
+
+	oldFile, _ := ioutil.ReadFile(cfg.Keepass.ServerPath)
+	saveInitialVersion()
+	err = WriteFileAtomically(cfg.Keepass.ServerPath, serverFile, verifyServerFile)
 	if err != nil{
+		internalServerError(w)
 		return err
 	}
+	changes, compared := replacementChanges(oldFile, serverFile)
+	summary := ""
+	if compared {
+		summary = summarizeChanges(changes)
+	}
+	saveVersion(serverFile, p.Key, replaceOperation, summary)
+	saveEntryDevices(p.Key, changes)
+
+	// the server can't open the sync base in the end-to-end mode, the client keeps its own sync base
+	if !cfg.Keepass.EndToEnd {
+		saveSyncBase(p.Key, serverFile)
+	}
 
-	resp := createResponse("", nil, "", "File successfully replaced on the server.")
+	resp := createVersionedResponse(nil, fileVersion(serverFile), "File successfully replaced on the server.")
 	err = sendResponseToClient(w, resp, 200)
 
 	return err
 }
 
+// compares the client file with the server file and returns the changes of a replacement without saving the client file
+func sendReplacementPreview(w http.ResponseWriter, clientFile []byte, p Payload) error{
+	// the server can't open the files in the end-to-end mode
+	if cfg.Keepass.EndToEnd {
+		payload := createResponse("", nil, "", "The server runs in the end-to-end mode, the files are compared by the client.")
+		return sendResponseToClient(w, payload, 400)
+	}
+
+	clientCredentials, err := clientCredentials(p)
+	if err != nil{
+		internalServerError(w)
+		return err
+	}
+
+	clientDb, serverDb, err := unlockDatabases(clientFile, clientCredentials, getServerDb())
+	if err != nil{
+		internalServerError(w)
+		return err
+	}
+	changes, err := m.Compare(serverDb, clientDb)
+	LockDatabase(clientDb)
+	LockDatabase(serverDb)
+	if err != nil{
+		internalServerError(w)
+		return err
+	}
+
+	payload := marshalResponse(Payload{Message: "Dry run, the server file was not replaced.", Changes: changes, Version: serverFileVersion()})
+	return sendResponseToClient(w, payload, 200)
+}
+
 // if the client entries are same or older than the server entries, we just send the server file back to the client
 func closeFilesAndSendResponse(w http.ResponseWriter, clientDb *gokeepasslib.Database, serverDb *gokeepasslib.Database)error{
 	LockDatabase(clientDb)
 	LockDatabase(serverDb)
-	payload := createResponse("", make([]byte, 0), "", "Success, but no need to change files")
+	payload := createVersionedResponse(nil, serverFileVersion(), "Success, but no need to change files")
 	return sendResponseToClient(w, payload, 200)
 }
 
@@ -213,6 +373,24 @@ func createResponse(key string, serverFile []byte, sig string, message string)[]
 	return payloadBytes
 }
 
+// creates a response body with the version of the server file
+func createVersionedResponse(serverFile []byte, version string, message string)[]byte{
+	return marshalResponse(Payload{
+		File: base64.StdEncoding.EncodeToString(serverFile),
+		Message: message,
+		Version: version,
+	})
+}
+
+// creates a response body from the payload
+func marshalResponse(payload Payload)[]byte{
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return payloadBytes
+}
+
 // sends a response back with given status and body payload
 func sendResponseToClient(w http.ResponseWriter, response []byte, status int) error{
 	w.Header().Set("content-type", "application/json")
@@ -232,6 +410,21 @@ func getServerDb() []byte{
 	return file
 }
 
+// returns the version of the keepass file on the server or an empty string if there is no file yet
+func serverFileVersion() string{
+	file, err := ioutil.ReadFile(cfg.Keepass.ServerPath)
+	if err != nil{
+		return ""
+	}
+	return fileVersion(file)
+}
+
+// returns the version of a keepass file, which is the hex encoded sha256 hash of the file
+func fileVersion(file []byte) string{
+	hash := sha256.Sum256(file)
+	return hex.EncodeToString(hash[:])
+}
+
 func internalServerError(w http.ResponseWriter) {
 	payload := createResponse("", nil, "", "internal server error")
 	if err := sendResponseToClient(w, payload, 500); err != nil{
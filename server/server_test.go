@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// creates a request with a signed envelope in the headers, like the client does
+func signedRequest(t *testing.T, privateKey ed25519.PrivateKey, method string, path string, p Payload, timestamp time.Time) *http.Request {
+	body, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	r.Header.Set(NonceHeader, base64.StdEncoding.EncodeToString(nonce))
+	envelope := RequestEnvelope(method, path, timestamp.Unix(), r.Header.Get(NonceHeader), body)
+	r.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, envelope)))
+	return r
+}
+
+// copies the request with the given body, the headers with the signature are kept
+func withBody(r *http.Request, method string, path string, body []byte) *http.Request {
+	copied := httptest.NewRequest(method, path, bytes.NewReader(body))
+	copied.Header = r.Header.Clone()
+	return copied
+}
+
+func TestReplaceFileRejectsStaleVersion(t *testing.T) {
+	serverFile, err := os.ReadFile("../merge/testdata/server.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFile, err := os.ReadFile("../merge/testdata/client.kdbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the end-to-end mode stores the uploaded file without opening it
+	cfg.Keepass.EndToEnd = true
+	cfg.Keepass.ServerPath = filepath.Join(t.TempDir(), "server.kdbx")
+	defer func() { cfg.Keepass.EndToEnd = false }()
+	if err := os.WriteFile(cfg.Keepass.ServerPath, serverFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &userHandler{store: &authorizedPublicKeys{pk: map[string]ed25519.PublicKey{"client": publicKey}}}
+	replace := func(version string, force bool) (int, Payload) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, signedRequest(t, privateKey, http.MethodPut, "/keepass", Payload{
+			Key:     "client",
+			File:    base64.StdEncoding.EncodeToString(clientFile),
+			Version: version,
+			Force:   force,
+		}, time.Now()))
+		var p Payload
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, p
+	}
+
+	// a client without the current version is rejected and gets the current version
+	status, p := replace("stale", false)
+	if status != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", status)
+	}
+	if p.Version != fileVersion(serverFile) {
+		t.Errorf("expected the version of the server file, got %q", p.Version)
+	}
+	if file, _ := os.ReadFile(cfg.Keepass.ServerPath); !bytes.Equal(file, serverFile) {
+		t.Error("the server file was replaced by a stale client")
+	}
+
+	// the current version and a forced replacement are accepted
+	if status, p = replace(fileVersion(serverFile), false); status != http.StatusOK || p.Version != fileVersion(clientFile) {
+		t.Errorf("expected the replacement with the current version, got %d %q", status, p.Version)
+	}
+	if status, _ = replace("stale", true); status != http.StatusOK {
+		t.Errorf("expected the forced replacement, got %d", status)
+	}
+}
+
+func TestVerifyRequestRejectsReplays(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := Payload{Key: "client", Message: "get file from server"}
+
+	signed := signedRequest(t, privateKey, http.MethodGet, "/keepass", payload, time.Now())
+	body, err := io.ReadAll(signed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the signature doesn't match for another endpoint
+	if verifyTestRequest(t, withBody(signed, http.MethodGet, "/keepass/history", body), publicKey) != http.StatusUnauthorized {
+		t.Error("expected the request for another path to be rejected")
+	}
+	if status := verifyTestRequest(t, withBody(signed, http.MethodGet, "/keepass", body), publicKey); status != http.StatusOK {
+		t.Fatalf("expected a valid request, got %d", status)
+	}
+	// the same request again and an old request are rejected
+	if verifyTestRequest(t, withBody(signed, http.MethodGet, "/keepass", body), publicKey) != http.StatusUnauthorized {
+		t.Error("expected the replayed request to be rejected")
+	}
+	old := signedRequest(t, privateKey, http.MethodGet, "/keepass", payload, time.Now().Add(-time.Hour))
+	if verifyTestRequest(t, old, publicKey) != http.StatusUnauthorized {
+		t.Error("expected the old request to be rejected")
+	}
+}
+
+// the signature covers the raw body, so the credentials, the file or any other field can't be changed
+func TestVerifyRequestRejectsChangedBodies(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := Payload{Key: "client", Message: "get file from server", Credentials: &Credentials{Passphrase: []byte("client passphrase")}}
+
+	signed := signedRequest(t, privateKey, http.MethodGet, "/keepass", payload, time.Now())
+	payload.Credentials.Passphrase = []byte("other passphrase")
+	changed, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyTestRequest(t, withBody(signed, http.MethodGet, "/keepass", changed), publicKey) != http.StatusUnauthorized {
+		t.Error("expected the request with other credentials to be rejected")
+	}
+
+	// a malformed signature is answered with 401 as well
+	malformed := signedRequest(t, privateKey, http.MethodGet, "/keepass", payload, time.Now())
+	malformed.Header.Set(SignatureHeader, "not base64!")
+	if verifyTestRequest(t, malformed, publicKey) != http.StatusUnauthorized {
+		t.Error("expected the request with a malformed signature to be rejected")
+	}
+}
+
+// verifies the request and returns the status of the response, 200 if the request was verified
+func verifyTestRequest(t *testing.T, r *http.Request, publicKey ed25519.PublicKey) int {
+	w := httptest.NewRecorder()
+	_, body, err := decodeRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, verified := verifyRequest(w, r, body, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		return http.StatusOK
+	}
+	return w.Code
+}
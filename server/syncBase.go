@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/tobischo/gokeepasslib/v3"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// the sync base is the last keepass file which the server sent to a client
+// it is stored for every public key and used as the common ancestor for the merge with the next client file
+
+// returns the directory of the sync bases, without a configured directory the sync bases are next to the server file
+// returns an empty string if the sync bases are disabled
+func syncBaseDirectory() string{
+	if cfg.Keepass.DisableSyncBase {
+		return ""
+	}
+	if cfg.Keepass.SyncBasePath != "" {
+		return cfg.Keepass.SyncBasePath
+	}
+	return filepath.Join(filepath.Dir(cfg.Keepass.ServerPath), "syncBases")
+}
+
+// returns the path of the sync base for the public key of a client
+func syncBasePath(publicKey string) string{
+	hash := sha256.Sum256([]byte(publicKey))
+	return filepath.Join(syncBaseDirectory(), hex.EncodeToString(hash[:])+".kdbx")
+}
+
+// loads the last file which the client got from the server
+// returns nil if the sync base is disabled or the server hasn't sent a file to this client yet
+func loadSyncBase(publicKey string) *gokeepasslib.Database{
+	if syncBaseDirectory() == ""{
+		return nil
+	}
+
+	file, err := ioutil.ReadFile(syncBasePath(publicKey))
+	if err != nil{
+		if !os.IsNotExist(err){
+			log.Println("The sync base of the client could not be read: ", err)
+		}
+		return nil
+	}
+
+	credentials, err := serverCredentials()
+	if err != nil{
+		log.Println("The credentials for the sync base could not be created: ", err)
+		return nil
+	}
+
+	db, err := unlockDatabase(file, credentials)
+	if err != nil{
+		log.Println("The sync base of the client could not be unlocked: ", err)
+		return nil
+	}
+	return db
+}
+
+// saves the file which was sent to the client as the sync base for the next merge with this client
+func saveSyncBase(publicKey string, file []byte){
+	directory := syncBaseDirectory()
+	if directory == ""{
+		return
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil{
+		log.Println("The directory for the sync bases could not be created: ", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(syncBasePath(publicKey), file, 0600); err != nil{
+		log.Println("The sync base of the client could not be saved: ", err)
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	c "local-pass-sync/config"
+)
+
+// the sync bases are kept next to the server file unless they are explicitly disabled
+func TestSyncBaseDirectory(t *testing.T) {
+	defer func() { cfg = c.Config{} }()
+	directory := t.TempDir()
+	cfg.Keepass.ServerPath = filepath.Join(directory, "server.kdbx")
+
+	saveSyncBase("key", []byte("file"))
+	if _, err := os.Stat(filepath.Join(directory, "syncBases")); err != nil {
+		t.Errorf("expected the sync base next to the server file, got %v", err)
+	}
+
+	cfg.Keepass.SyncBasePath = filepath.Join(directory, "configured")
+	if syncBaseDirectory() != cfg.Keepass.SyncBasePath {
+		t.Errorf("expected the configured directory, got %s", syncBaseDirectory())
+	}
+
+	cfg.Keepass.DisableSyncBase = true
+	if syncBaseDirectory() != "" || loadSyncBase("key") != nil {
+		t.Error("expected no sync base if it is disabled")
+	}
+}